@@ -25,9 +25,13 @@ import (
 
 	"sigs.k8s.io/kind/pkg/apis/config/v1alpha4"
 	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
 )
 
+// pluginName is used to label the resources owned by the plugin
+const pluginName = "baremetal"
+
 // Config struct for multicluster config
 type Config struct {
 	Cluster  v1alpha4.Cluster `yaml:"cluster"`
@@ -84,6 +88,11 @@ func init() {
 		"the config file with the cluster configuration",
 	)
 	createCmd.MarkFlagRequired("config")
+	createCmd.Flags().StringSlice(
+		"images",
+		[]string{},
+		"image tarballs or local images loaded in the nodes, the node images have to be local or loaded",
+	)
 }
 
 func createBareMetal(cmd *cobra.Command) error {
@@ -95,10 +104,26 @@ func createBareMetal(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	imageArgs, err := cmd.Flags().GetStringSlice("images")
+	if err != nil {
+		return err
+	}
 	cfg, err := NewConfig(configPath)
 	if err != nil {
 		return err
 	}
+	// load the images before creating anything, so
+	// creating the cluster offline fails fast
+	images := []string{}
+	if len(imageArgs) > 0 {
+		images, err = docker.LoadImages(imageArgs)
+		if err != nil {
+			return err
+		}
+		if err := docker.CheckImages(docker.NodeImages(&cfg.Cluster)); err != nil {
+			return err
+		}
+	}
 
 	// create the clusters
 	logger := kindcmd.NewLogger()
@@ -106,9 +131,14 @@ func createBareMetal(cmd *cobra.Command) error {
 		cluster.ProviderWithLogger(logger),
 	)
 	clusterNetwork := "bm-" + name
+	// label all the networks with the owner and the cluster attached
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.ClusterLabel: name},
+	)
 	// use a separate network for the cluster
 	// autoallocate subnet and allow masquerading
-	err = docker.CreateNetwork(clusterNetwork, "", true)
+	err = docker.CreateNetwork(clusterNetwork, "", true, labels)
 	if err != nil {
 		return err
 	}
@@ -136,8 +166,16 @@ func createBareMetal(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	// load the images in the nodes, like kind load
+	internal, err := nodeutils.InternalNodes(nodes)
+	if err != nil {
+		return err
+	}
+	if err := docker.LoadNodeImages(internal, images); err != nil {
+		return err
+	}
 	for _, networkName := range cfg.Networks {
-		err = docker.CreateNetwork(networkName, "", false)
+		err = docker.CreateNetwork(networkName, "", false, labels)
 		if err != nil {
 			return err
 		}
@@ -16,8 +16,6 @@ limitations under the License.
 package cmd
 
 import (
-	"strings"
-
 	"github.com/aojea/kind-networking-plugins/pkg/docker"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
@@ -30,7 +28,10 @@ import (
 var deleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete the baremetal cluster",
-	Long:  `Delete the baremetal cluster.`,
+	Long: `Delete the baremetal cluster.
+
+The cluster and its networks are found using the owner labels
+set when the cluster was created, so the config file is not needed.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return deleteBareMetal(cmd)
 	},
@@ -49,7 +50,7 @@ func init() {
 		"./config.yml",
 		"the config file with the cluster configuration",
 	)
-	deleteCmd.MarkFlagRequired("config")
+	deleteCmd.Flags().MarkDeprecated("config", "resources are found using the owner labels")
 }
 
 func deleteBareMetal(cmd *cobra.Command) error {
@@ -57,14 +58,6 @@ func deleteBareMetal(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
-	configPath, err := cmd.Flags().GetString("config")
-	if err != nil {
-		return err
-	}
-	cfg, err := NewConfig(configPath)
-	if err != nil {
-		return err
-	}
 
 	logger := kindcmd.NewLogger()
 
@@ -76,28 +69,33 @@ func deleteBareMetal(cmd *cobra.Command) error {
 		return err
 	}
 
-	for _, cluster := range clusters {
-		if cluster == name {
-			if err = provider.Delete(cluster, ""); err != nil {
-				logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", cluster))
-				continue
-			}
-			logger.V(0).Infof("Deleted clusters: %q", cluster)
-		}
-	}
-	clusterNamePrefix := "bm-" + name
-	// delete zones bridges and network
-	networks, err := docker.ListNetwork()
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
 	if err != nil {
 		return err
 	}
+	// delete the cluster attached to the networks first
+	// so the networks don't have containers attached
 	for _, network := range networks {
-		if strings.Contains(network, clusterNamePrefix) ||
-			sliceContains(cfg.Networks, network) {
-			if err = docker.DeleteNetwork(network); err != nil {
-				logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete network %q", network))
-				continue
-			}
+		labels, err := docker.GetNetworkLabels(network)
+		if err != nil {
+			return err
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if !ok || !sliceContains(clusters, clusterName) {
+			continue
+		}
+		if err = provider.Delete(clusterName, ""); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", clusterName))
+			continue
+		}
+		// the cluster may be attached to multiple networks
+		clusters = removeFromSlice(clusters, clusterName)
+		logger.V(0).Infof("Deleted clusters: %q", clusterName)
+	}
+	for _, network := range networks {
+		if err = docker.DeleteNetwork(network); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete network %q", network))
+			continue
 		}
 	}
 	// TODO accumulate errors
@@ -112,3 +110,13 @@ func sliceContains(slice []string, a string) bool {
 	}
 	return false
 }
+
+func removeFromSlice(slice []string, a string) []string {
+	out := []string{}
+	for _, s := range slice {
+		if a != s {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -17,7 +17,10 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
 
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/topology"
 	"github.com/spf13/cobra"
 	"sigs.k8s.io/kind/pkg/cluster"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
@@ -26,13 +29,13 @@ import (
 // getCmd represents the get command
 var getCmd = &cobra.Command{
 	Use:   "get",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Get the baremetal cluster",
+	Long: `Get the baremetal cluster.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+By default it prints the cluster found, the dot and mermaid outputs render
+the topology as a Graphviz or Mermaid diagram: the cluster network and the
+secondary networks with their subnets, and the nodes with their IPs on each
+network.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return getMultiCluster(cmd)
 	},
@@ -45,7 +48,12 @@ func init() {
 		cluster.DefaultName,
 		"the multicluster context name",
 	)
-
+	getCmd.Flags().StringP(
+		"output",
+		"o",
+		"",
+		"output format: dot or mermaid, by default the clusters found are printed",
+	)
 }
 
 func getMultiCluster(cmd *cobra.Command) error {
@@ -53,6 +61,13 @@ func getMultiCluster(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	if output != "" && !topology.IsFormat(output) {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
 
 	logger := kindcmd.NewLogger()
 
@@ -64,10 +79,55 @@ func getMultiCluster(cmd *cobra.Command) error {
 		return err
 	}
 
-	for _, cluster := range clusters {
-		if cluster == name {
-			fmt.Println("Cluster found:", cluster)
+	// the cluster is found through the labels of its networks
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	found := []string{}
+	for _, network := range networks {
+		labels, err := docker.GetNetworkLabels(network)
+		if err != nil {
+			return err
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if ok && sliceContains(clusters, clusterName) && !sliceContains(found, clusterName) {
+			if output == "" {
+				fmt.Println("Cluster found:", clusterName)
+			}
+			found = append(found, clusterName)
+		}
+	}
+	if output == "" {
+		return nil
+	}
+	g, err := getGraph(provider, name, networks, found)
+	if err != nil {
+		return err
+	}
+	return topology.Write(cmd.OutOrStdout(), g, output)
+}
+
+// getGraph obtains the topology diagram of the cluster, the nodes are
+// attached to the cluster network and to the secondary networks
+func getGraph(provider *cluster.Provider, name string, networks, clusters []string) (*topology.Graph, error) {
+	sort.Strings(networks)
+	g := &topology.Graph{Name: name}
+	var err error
+	g.Networks, err = topology.NewNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+	for _, clusterName := range clusters {
+		nodes, err := provider.ListNodes(clusterName)
+		if err != nil {
+			return nil, err
+		}
+		c, err := topology.NewCluster(clusterName, nodes, networks)
+		if err != nil {
+			return nil, err
 		}
+		g.Clusters = append(g.Clusters, c)
 	}
-	return nil
+	return g, nil
 }
@@ -7,6 +7,8 @@ require (
 	github.com/spf13/cobra v1.1.3
 	github.com/vishvananda/netlink v1.1.0
 	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c
 	gopkg.in/yaml.v2 v2.4.0
 	sigs.k8s.io/kind v0.10.1-0.20210328125044-8fe8b962521d
 )
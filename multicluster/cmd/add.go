@@ -0,0 +1,177 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+)
+
+// addCmd represents the add command
+var addCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a cluster to a running multicluster",
+	Long: `Add a cluster to a running multicluster.
+
+The cluster is defined in the config file, it is created in its own network
+connected to the WAN emulator of the multicluster, and the links from or to
+the cluster defined in the config file are configured in the WAN emulator.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return addCluster(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(addCmd)
+
+	addCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	addCmd.Flags().String(
+		"config",
+		"./config.yml",
+		"the config file with the cluster configuration",
+	)
+	addCmd.Flags().String(
+		"cluster",
+		"",
+		"the name of the cluster in the config file to add",
+	)
+	addCmd.MarkFlagRequired("cluster")
+}
+
+func addCluster(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	clusterName, err := cmd.Flags().GetString("cluster")
+	if err != nil {
+		return err
+	}
+	cfg, err := NewConfig(configPath)
+	if err != nil {
+		return err
+	}
+	clusterConfig, ok := cfg.Clusters[clusterName]
+	if !ok {
+		return fmt.Errorf("cluster %s not found in config %s", clusterName, configPath)
+	}
+	if _, err := clusterConfig.kindConfig(clusterName); err != nil {
+		return errors.Wrapf(err, "invalid configuration for cluster %s", clusterName)
+	}
+	if err := cfg.Topology.validate(cfg.Clusters); err != nil {
+		return errors.Wrap(err, "invalid topology")
+	}
+	if err := validateEgress(cfg); err != nil {
+		return err
+	}
+
+	// the clusters of a flat network are fixed when the network is created
+	mode, err := multiClusterMode(name)
+	if err != nil {
+		return err
+	}
+	if mode == flatMode {
+		return fmt.Errorf("clusters can not be added to a multicluster in %s mode", mode)
+	}
+
+	// the multicluster has to be running and the cluster must not exist
+	containers, err := docker.ListContainersByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	if !sliceContains(containers, "wan-"+name) {
+		return fmt.Errorf("multicluster %s not found", name)
+	}
+	// the firewall rules are recorded when the multicluster is created
+	rules, err := wanFirewallRules(name)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Firewall) > 0 && !reflect.DeepEqual(cfg.Firewall, rules) {
+		return fmt.Errorf("the firewall rules of multicluster %s are fixed when it is created and do not match the ones of %s", name, configPath)
+	}
+	networks, err := docker.ListNetwork()
+	if err != nil {
+		return err
+	}
+	if sliceContains(networks, clusterName) {
+		return fmt.Errorf("network %s already exists", clusterName)
+	}
+	rename, err := wanRenameInterfaces(name)
+	if err != nil {
+		return err
+	}
+	if rename {
+		if err := validateRenameInterfaces([]string{clusterName}); err != nil {
+			return err
+		}
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	if err := createMemberCluster(provider, name, clusterName, clusterConfig, cfg.Topology.labels(clusterName)); err != nil {
+		return err
+	}
+	// the new cluster may be a spoke or the transit hub
+	if err := applyTopology(provider, name); err != nil {
+		return err
+	}
+	if err := configureAPIServers(provider, name); err != nil {
+		return err
+	}
+	// configure the proxy in the new cluster and the
+	// subnets of the new cluster in the other clusters
+	port, err := wanProxyPort(name)
+	if err != nil {
+		return err
+	}
+	if port > 0 {
+		if err := configureProxy(provider, name); err != nil {
+			return err
+		}
+	}
+
+	// configure only the links from or to the new cluster
+	links := []LinkConfig{}
+	for _, l := range cfg.Links {
+		if l.From == clusterName || l.To == clusterName {
+			links = append(links, l)
+		}
+	}
+	if err := applyLinks(name, links); err != nil {
+		return err
+	}
+	// rebuild the firewall, the new cluster may be in the rules
+	return applyFirewall(name)
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// airgapLabel records in the routers that the clusters have no egress
+	airgapLabel = "io.x-k8s.kind-networking-plugins.airgap"
+	// mirrorsLabel records in the registry the registries it mirrors
+	mirrorsLabel = "io.x-k8s.kind-networking-plugins.mirrors"
+	registryRole = "registry"
+
+	defaultRegistryImage = "registry:2"
+	registryPort         = "5000"
+)
+
+func registryName(name string) string {
+	return "registry-" + name
+}
+
+// validateAirgap checks that the configuration does not give egress to the clusters
+func validateAirgap(cfg *Config) error {
+	switch {
+	case cfg.Mode == flatMode:
+		return fmt.Errorf("airgap is not supported in flat mode")
+	case cfg.Egress.Subnet != "":
+		return fmt.Errorf("airgap is not compatible with egress")
+	case cfg.Proxy.Enabled:
+		return fmt.Errorf("airgap is not compatible with the proxy")
+	}
+	return nil
+}
+
+// createRegistry runs the local registry of the air-gapped multicluster, seeded
+// with the named images of the tarballs. The images are loaded in the host and pushed
+// to the registry through a port published in localhost, that docker trusts
+// without TLS. The registries of the images are recorded as the mirrors of the
+// registry, so the nodes pull the images of those registries from it.
+func createRegistry(name, image string, tarballs []string) error {
+	logger := kindcmd.NewLogger()
+	images := []string{}
+	for _, t := range tarballs {
+		names, ids, err := docker.LoadImageArchive(t)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			logger.Warnf("Image %s of %s has no name, it is not pushed to the registry", id, t)
+		}
+		images = append(images, names...)
+	}
+	mirrors := []string{}
+	for _, img := range images {
+		domain, _ := splitImageReference(img)
+		if !sliceContains(mirrors, domain) {
+			mirrors = append(mirrors, domain)
+		}
+	}
+	sort.Strings(mirrors)
+
+	registry := registryName(name)
+	args := []string{"run",
+		"-d", // run in the background
+		"--name", registry,
+		"-p", "127.0.0.1::" + registryPort,
+	}
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{
+			docker.RoleLabel: registryRole,
+			mirrorsLabel:     strings.Join(mirrors, ","),
+		},
+	)
+	args = append(args, docker.LabelArgs(labels)...)
+	args = append(args, image)
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrapf(err, "failed to run registry %s", registry)
+	}
+	// output format: 127.0.0.1:49153
+	lines, err := exec.OutputLines(exec.Command("docker", "port", registry, registryPort+"/tcp"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the published port of registry %s", registry)
+	}
+	if len(lines) == 0 {
+		return fmt.Errorf("registry %s has no published port", registry)
+	}
+	host := lines[0]
+	if err := waitRegistry(host, time.Minute); err != nil {
+		return err
+	}
+
+	for _, img := range images {
+		_, path := splitImageReference(img)
+		local := host + "/" + path
+		if err := exec.Command("docker", "tag", img, local).Run(); err != nil {
+			return errors.Wrapf(err, "failed to tag image %s", img)
+		}
+		err := exec.Command("docker", "push", local).Run()
+		// remove the local tag, the image is kept with its name
+		exec.Command("docker", "rmi", local).Run()
+		if err != nil {
+			return errors.Wrapf(err, "failed to push image %s to registry %s", img, registry)
+		}
+		logger.V(0).Infof("Pushed image %s to registry %s", img, registry)
+	}
+	return nil
+}
+
+// waitRegistry waits until the registry API answers
+func waitRegistry(host string, timeout time.Duration) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := client.Get("http://" + host + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("registry %s not ready after %v", host, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// splitImageReference returns the registry domain and the repository path of
+// an image reference, with the defaults of docker for the familiar names
+func splitImageReference(ref string) (string, string) {
+	domain, path := "docker.io", ref
+	if i := strings.Index(ref, "/"); i != -1 {
+		if d := ref[:i]; strings.ContainsAny(d, ".:") || d == "localhost" {
+			domain, path = d, ref[i+1:]
+		}
+	}
+	if domain == "docker.io" && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return domain, path
+}
+
+// airgapRegistry returns the registry of the multicluster and the
+// registries it mirrors, or an empty name if it is not air-gapped
+func airgapRegistry(name string) (string, []string, error) {
+	registry := registryName(name)
+	containers, err := docker.ListContainersByLabel(docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.RoleLabel: registryRole},
+	))
+	if err != nil || !sliceContains(containers, registry) {
+		return "", nil, err
+	}
+	labels, err := docker.GetContainerLabels(registry)
+	if err != nil {
+		return "", nil, err
+	}
+	mirrors := []string{}
+	if labels[mirrorsLabel] != "" {
+		mirrors = strings.Split(labels[mirrorsLabel], ",")
+	}
+	return registry, mirrors, nil
+}
+
+// registryMirrorsPatch returns the containerd configuration patch that pulls the
+// images of the mirrored registries from the registry, resolved by the docker DNS
+func registryMirrorsPatch(registry string, mirrors []string) string {
+	var b strings.Builder
+	for _, m := range mirrors {
+		fmt.Fprintf(&b, "[plugins.\"io.containerd.grpc.v1.cri\".registry.mirrors.%q]\n", m)
+		fmt.Fprintf(&b, "  endpoint = [\"http://%s:%s\"]\n", registry, registryPort)
+	}
+	return b.String()
+}
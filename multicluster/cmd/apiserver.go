@@ -0,0 +1,280 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/apis/config/v1alpha4"
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// apiServerPort is the port of the API server inside the cluster network
+	apiServerPort = "6443"
+	// apiServerChain is the chain that forwards the API server port of the
+	// cluster gateways to the API server endpoint of each cluster
+	apiServerChain = "MULTICLUSTER-APISERVER"
+)
+
+// kubeconfigCmd represents the kubeconfig command
+var kubeconfigCmd = &cobra.Command{
+	Use:   "kubeconfig",
+	Short: "Print the internal kubeconfig of a cluster",
+	Long: `Print the internal kubeconfig of a cluster.
+
+The API server of the cluster is reachable from the other clusters at the
+gateway of its network, that is part of the API server certificate, and the
+kubeconfig points to that address so it can be used from the pods of the
+peer clusters. In flat mode the kubeconfig points to the API server endpoint
+node, that is reachable from all the clusters.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runKubeconfig(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(kubeconfigCmd)
+
+	kubeconfigCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	kubeconfigCmd.Flags().String(
+		"cluster",
+		"",
+		"the cluster of the kubeconfig",
+	)
+	kubeconfigCmd.MarkFlagRequired("cluster")
+}
+
+func runKubeconfig(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	clusterName, err := cmd.Flags().GetString("cluster")
+	if err != nil {
+		return err
+	}
+	kubeconfig, err := internalKubeconfig(name, clusterName)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(cmd.OutOrStdout(), kubeconfig)
+	return nil
+}
+
+// internalKubeconfig returns the kubeconfig of the cluster for the peer clusters
+func internalKubeconfig(name, clusterName string) (string, error) {
+	mode, err := multiClusterMode(name)
+	if err != nil {
+		return "", err
+	}
+	found, err := hasCluster(name, clusterName)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("cluster %s not found in multicluster %s", clusterName, name)
+	}
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(kindcmd.NewLogger()),
+	)
+	// the kubeconfig uses the hostname of the API server endpoint node, that
+	// the docker DNS resolves in the shared network of the flat mode
+	kubeconfig, err := provider.KubeConfig(clusterName, true)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get the kubeconfig of cluster %s", clusterName)
+	}
+	if mode == flatMode {
+		return kubeconfig, nil
+	}
+	gateways, err := apiServerAddresses(clusterName)
+	if err != nil {
+		return "", err
+	}
+	server := "https://" + net.JoinHostPort(gateways[0], apiServerPort)
+	lines := strings.Split(kubeconfig, "\n")
+	for i, l := range lines {
+		if strings.HasPrefix(strings.TrimSpace(l), "server: ") {
+			lines[i] = l[:strings.Index(l, "server: ")] + "server: " + server
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// hasCluster returns true if the cluster belongs to the multicluster
+func hasCluster(name, clusterName string) (bool, error) {
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return false, err
+	}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return false, err
+		}
+		for _, clusterLabels := range networkClusterLabels(labels) {
+			if clusterLabels[docker.ClusterLabel] == clusterName {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// apiServerAddresses returns the addresses of the API server of the cluster
+// reachable across the WAN, the gateways of the cluster network
+func apiServerAddresses(clusterName string) ([]string, error) {
+	subnets, err := docker.GetNetworkSubnets(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return routerAddresses(strings.Join(subnets, ","), 0, false)
+}
+
+// apiServerCertSANsPatch returns the kubeadm patch that adds the addresses to
+// the API server certificate, appending them to the SANs added by kind
+func apiServerCertSANsPatch(addresses []string) (v1alpha4.PatchJSON6902, error) {
+	ops := []map[string]string{}
+	for _, a := range addresses {
+		ops = append(ops, map[string]string{"op": "add", "path": "/apiServer/certSANs/-", "value": a})
+	}
+	patch, err := json.Marshal(ops)
+	if err != nil {
+		return v1alpha4.PatchJSON6902{}, err
+	}
+	// without group and version the patch applies to all the kubeadm versions
+	return v1alpha4.PatchJSON6902{
+		Kind:  "ClusterConfiguration",
+		Patch: string(patch),
+	}, nil
+}
+
+// configureAPIServers replaces the rules that forward the API server port of
+// the gateway of each cluster to its API server endpoint, the control plane
+// node or the external load balancer of the clusters with multiple control
+// planes. The gateways are owned by the WAN routers, or by the edge gateways
+// with the tunnel interconnect.
+func configureAPIServers(provider *cluster.Provider, name string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	// the rules of each container that owns gateways
+	rules := map[string][][]string{}
+	for _, router := range routers {
+		rules[router] = [][]string{}
+	}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return err
+		}
+		if labels[docker.ClusterLabel] != n {
+			continue
+		}
+		allNodes, err := provider.ListNodes(n)
+		if err != nil {
+			return err
+		}
+		endpoint, err := nodeutils.APIServerEndpointNode(allNodes)
+		if err != nil {
+			return err
+		}
+		ipv4, ipv6, err := endpoint.IP()
+		if err != nil {
+			return err
+		}
+		gateways, err := apiServerAddresses(n)
+		if err != nil {
+			return err
+		}
+		owners := routers
+		if interconnect != routedInterconnect {
+			owners = []string{edgeName(n)}
+		}
+		for _, gw := range gateways {
+			ip, iptables := ipv4, "iptables"
+			if net.ParseIP(gw).To4() == nil {
+				ip, iptables = ipv6, "ip6tables"
+			}
+			if ip == "" {
+				continue
+			}
+			rule := []string{iptables,
+				"-d", gw, "-p", "tcp", "--dport", apiServerPort,
+				"-m", "comment", "--comment", fmt.Sprintf("API server of cluster %s", n),
+				"-j", "DNAT", "--to-destination", net.JoinHostPort(ip, apiServerPort)}
+			for _, o := range owners {
+				rules[o] = append(rules[o], rule)
+			}
+		}
+	}
+	for container, containerRules := range rules {
+		if err := applyAPIServerRules(container, containerRules); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyAPIServerRules replaces the API server rules of the container, the
+// first element of each rule is the iptables command of its IP family
+func applyAPIServerRules(container string, rules [][]string) error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		// the chain may exist if the API servers were already configured
+		exec.Command("docker", "exec", container, iptables, "-t", "nat", "-N", apiServerChain).Run()
+		cmds := [][]string{{"-F", apiServerChain}}
+		for _, rule := range rules {
+			if rule[0] == iptables {
+				cmds = append(cmds, append([]string{"-A", apiServerChain}, rule[1:]...))
+			}
+		}
+		if exec.Command("docker", "exec", container, iptables, "-t", "nat", "-C", "PREROUTING", "-j", apiServerChain).Run() != nil {
+			cmds = append(cmds, []string{"-I", "PREROUTING", "-j", apiServerChain})
+		}
+		for _, c := range cmds {
+			args := append([]string{"exec", container, iptables, "-t", "nat"}, c...)
+			if err := exec.Command("docker", args...).Run(); err != nil {
+				return errors.Wrapf(err, "failed to run %s %s on %s", iptables, strings.Join(c, " "), container)
+			}
+		}
+	}
+	return nil
+}
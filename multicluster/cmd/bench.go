@@ -0,0 +1,368 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// dockerBenchImage is the image of the bench tool, it is not
+	// published, make images builds it
+	dockerBenchImage = "kind-networking-plugins/bench:v1"
+	benchNamespace   = "multicluster-bench"
+	benchPort        = 5201
+)
+
+// benchServerManifest runs the bench server in the destination cluster
+const benchServerManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: bench-server
+  namespace: %[1]s
+spec:
+  containers:
+  - name: bench
+    image: %[2]s
+    imagePullPolicy: IfNotPresent
+    args: ["server", "--port=%[3]d"]
+`
+
+// benchClientManifest runs a pod in the source cluster to exec the bench client
+const benchClientManifest = `apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: bench-client
+  namespace: %[1]s
+spec:
+  containers:
+  - name: bench
+    image: %[2]s
+    imagePullPolicy: IfNotPresent
+    command: ["sleep", "infinity"]
+`
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measure the throughput and latency between two clusters",
+	Long: `Measure the throughput and latency between two clusters.
+
+Deploy a bench server pod in the destination cluster and a bench client pod in
+the source cluster, and measure the throughput, the RTT percentiles and the TCP
+retransmits or UDP loss over the WAN path between the pods.
+
+With --profiles, the benchmark is repeated for each impairment profile defined
+in the config file, applying the profile to both directions of the path, and
+the links of the config file are restored at the end.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return benchMultiCluster(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	benchCmd.Flags().String(
+		"from",
+		"",
+		"the cluster running the bench client",
+	)
+	benchCmd.Flags().String(
+		"to",
+		"",
+		"the cluster running the bench server",
+	)
+	benchCmd.Flags().String(
+		"protocol",
+		"tcp",
+		"the protocol to measure: tcp or udp",
+	)
+	benchCmd.Flags().Duration(
+		"duration",
+		10*time.Second,
+		"the duration of each throughput test",
+	)
+	benchCmd.Flags().String(
+		"rate",
+		"100e6",
+		"the UDP sending rate in bits per second",
+	)
+	benchCmd.Flags().String(
+		"image",
+		dockerBenchImage,
+		"the image with the bench tool",
+	)
+	benchCmd.Flags().Bool(
+		"profiles",
+		false,
+		"repeat the benchmark for each impairment profile in the config file",
+	)
+	benchCmd.Flags().String(
+		"config",
+		"./config.yml",
+		"the config file with the impairment profiles",
+	)
+	benchCmd.Flags().StringP(
+		"output",
+		"o",
+		"table",
+		"output format: table or json",
+	)
+	benchCmd.MarkFlagRequired("from")
+	benchCmd.MarkFlagRequired("to")
+}
+
+// BenchResult is the result of the bench tool for an impairment profile
+type BenchResult struct {
+	Profile     string  `json:"profile"`
+	Protocol    string  `json:"protocol"`
+	Server      string  `json:"server"`
+	Duration    float64 `json:"duration"`
+	Bytes       uint64  `json:"bytes"`
+	Throughput  float64 `json:"throughput"`
+	RTT         RTT     `json:"rtt"`
+	Retransmits uint32  `json:"retransmits"`
+	Loss        float64 `json:"loss"`
+}
+
+// RTT contains the round trip time percentiles in milliseconds
+type RTT struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func benchMultiCluster(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	from, err := cmd.Flags().GetString("from")
+	if err != nil {
+		return err
+	}
+	to, err := cmd.Flags().GetString("to")
+	if err != nil {
+		return err
+	}
+	protocol, err := cmd.Flags().GetString("protocol")
+	if err != nil {
+		return err
+	}
+	duration, err := cmd.Flags().GetDuration("duration")
+	if err != nil {
+		return err
+	}
+	rate, err := cmd.Flags().GetString("rate")
+	if err != nil {
+		return err
+	}
+	image, err := cmd.Flags().GetString("image")
+	if err != nil {
+		return err
+	}
+	withProfiles, err := cmd.Flags().GetBool("profiles")
+	if err != nil {
+		return err
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	if output != "table" && output != "json" {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
+
+	cfg := &Config{}
+	if withProfiles {
+		configPath, err := cmd.Flags().GetString("config")
+		if err != nil {
+			return err
+		}
+		cfg, err = NewConfig(configPath)
+		if err != nil {
+			return err
+		}
+		if len(cfg.Profiles) == 0 {
+			return fmt.Errorf("no impairment profiles found in %s", configPath)
+		}
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	serverNode, err := controlPlaneNode(provider, to)
+	if err != nil {
+		return err
+	}
+	clientNode, err := controlPlaneNode(provider, from)
+	if err != nil {
+		return err
+	}
+
+	// the bench image is built locally and not published, it is loaded in
+	// the nodes of both clusters if the host has it, as kind load does
+	if docker.ImageExists(image) {
+		if err := loadClusterImages(provider, []string{to, from}, []string{image}); err != nil {
+			return err
+		}
+	} else {
+		logger.Warnf("Image %s not found in the host, the nodes have to pull it, build it with make images", image)
+	}
+
+	logger.V(0).Infof("Deploying bench server in cluster %s and client in cluster %s", to, from)
+	err = kubectl(serverNode, "apply", "-f", "-").
+		SetStdin(strings.NewReader(fmt.Sprintf(benchServerManifest, benchNamespace, image, benchPort))).Run()
+	if err != nil {
+		return errors.Wrapf(err, "failed to deploy bench server in cluster %s", to)
+	}
+	defer kubectl(serverNode, "delete", "namespace", benchNamespace, "--wait=false").Run()
+	err = kubectl(clientNode, "apply", "-f", "-").
+		SetStdin(strings.NewReader(fmt.Sprintf(benchClientManifest, benchNamespace, image))).Run()
+	if err != nil {
+		return errors.Wrapf(err, "failed to deploy bench client in cluster %s", from)
+	}
+	defer kubectl(clientNode, "delete", "namespace", benchNamespace, "--wait=false").Run()
+
+	for _, n := range []nodes.Node{serverNode, clientNode} {
+		err := kubectl(n, "wait", "-n", benchNamespace, "--for=condition=Ready", "pod", "--all", "--timeout=5m").Run()
+		if err != nil {
+			return errors.Wrap(err, "bench pods not ready")
+		}
+	}
+	lines, err := exec.OutputLines(kubectl(serverNode, "get", "-n", benchNamespace, "pod", "bench-server",
+		"-o", "jsonpath={.status.podIP}"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get bench server IP in cluster %s", to)
+	}
+	if len(lines) != 1 {
+		return fmt.Errorf("unexpected bench server IP in cluster %s: %v", to, lines)
+	}
+	server := hostPort(lines[0], benchPort)
+
+	args := []string{"exec", "-n", benchNamespace, "bench-client", "--",
+		"/bench", "client",
+		"--server=" + server,
+		"--protocol=" + protocol,
+		"--duration=" + duration.String(),
+		"--rate=" + rate,
+	}
+	runBench := func(profile string) (BenchResult, error) {
+		logger.V(0).Infof("Running %s benchmark from %s to %s with profile %s", protocol, from, to, profile)
+		result := BenchResult{Profile: profile}
+		lines, err := exec.OutputLines(kubectl(clientNode, args...))
+		if err != nil {
+			return result, errors.Wrapf(err, "bench client failed with profile %s", profile)
+		}
+		if len(lines) == 0 {
+			return result, fmt.Errorf("bench client returned no results with profile %s", profile)
+		}
+		err = json.Unmarshal([]byte(lines[len(lines)-1]), &result)
+		return result, err
+	}
+
+	// the current state of the WAN is always measured
+	results := []BenchResult{}
+	result, err := runBench("current")
+	if err != nil {
+		return err
+	}
+	results = append(results, result)
+
+	if withProfiles {
+		// restore the links of the config file for the path after the profiles
+		defer func() {
+			if err := restoreLinks(name, from, to, cfg.Links); err != nil {
+				logger.Warnf("Failed to restore the links between %s and %s: %v", from, to, err)
+			}
+		}()
+		profiles := make([]string, 0, len(cfg.Profiles))
+		for p := range cfg.Profiles {
+			profiles = append(profiles, p)
+		}
+		sort.Strings(profiles)
+		for _, p := range profiles {
+			if err := setLinkImpairment(name, from, to, cfg.Profiles[p]); err != nil {
+				return err
+			}
+			if err := setLinkImpairment(name, to, from, cfg.Profiles[p]); err != nil {
+				return err
+			}
+			result, err := runBench(p)
+			if err != nil {
+				return err
+			}
+			results = append(results, result)
+		}
+	}
+
+	out := cmd.OutOrStdout()
+	if output == "json" {
+		b, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(b))
+		return nil
+	}
+	printBenchTable(out, results)
+	return nil
+}
+
+func printBenchTable(out io.Writer, results []BenchResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tPROTOCOL\tTHROUGHPUT\tRTT-MIN\tRTT-P50\tRTT-P90\tRTT-P99\tRETRANSMITS\tLOSS")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%.2f Mbit/s\t%.2fms\t%.2fms\t%.2fms\t%.2fms\t%d\t%.2f%%\n",
+			r.Profile, r.Protocol, r.Throughput/1e6, r.RTT.Min, r.RTT.P50, r.RTT.P90, r.RTT.P99, r.Retransmits, r.Loss)
+	}
+	w.Flush()
+}
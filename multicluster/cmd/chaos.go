@@ -0,0 +1,397 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+)
+
+// chaos actions
+const (
+	chaosLatency   = "latency"
+	chaosLoss      = "loss"
+	chaosPartition = "partition"
+	chaosBandwidth = "bandwidth"
+)
+
+// ChaosConfig defines the bounds of the random impairments of the chaos mode
+type ChaosConfig struct {
+	// Actions are the impairments applied: latency, loss, partition
+	// and bandwidth, all of them if not set
+	Actions []string `yaml:"actions,omitempty"`
+	// MinInterval and MaxInterval bound the time between actions
+	MinInterval time.Duration `yaml:"minInterval,omitempty"`
+	MaxInterval time.Duration `yaml:"maxInterval,omitempty"`
+	// MinDuration and MaxDuration bound how long an action lasts
+	MinDuration time.Duration `yaml:"minDuration,omitempty"`
+	MaxDuration time.Duration `yaml:"maxDuration,omitempty"`
+	// MaxPartition bounds how long a partition lasts
+	MaxPartition time.Duration `yaml:"maxPartition,omitempty"`
+	// MaxDelay bounds the latency spikes
+	MaxDelay time.Duration `yaml:"maxDelay,omitempty"`
+	// MaxLoss bounds the percentage of packets dropped by the loss bursts
+	MaxLoss float64 `yaml:"maxLoss,omitempty"`
+	// MinRateKbit and MaxRateKbit bound the bandwidth drops, in kbit/s
+	MinRateKbit int `yaml:"minRateKbit,omitempty"`
+	MaxRateKbit int `yaml:"maxRateKbit,omitempty"`
+}
+
+// withDefaults returns the configuration with the default values of the fields not set
+func (c ChaosConfig) withDefaults() ChaosConfig {
+	if len(c.Actions) == 0 {
+		c.Actions = []string{chaosLatency, chaosLoss, chaosPartition, chaosBandwidth}
+	}
+	if c.MinInterval == 0 {
+		c.MinInterval = 10 * time.Second
+	}
+	if c.MaxInterval == 0 {
+		c.MaxInterval = 60 * time.Second
+	}
+	if c.MinDuration == 0 {
+		c.MinDuration = 5 * time.Second
+	}
+	if c.MaxDuration == 0 {
+		c.MaxDuration = 60 * time.Second
+	}
+	if c.MaxPartition == 0 {
+		c.MaxPartition = 15 * time.Second
+	}
+	if c.MaxDelay == 0 {
+		c.MaxDelay = 500 * time.Millisecond
+	}
+	if c.MaxLoss == 0 {
+		c.MaxLoss = 20
+	}
+	if c.MinRateKbit == 0 {
+		c.MinRateKbit = 1000
+	}
+	if c.MaxRateKbit == 0 {
+		c.MaxRateKbit = 100000
+	}
+	return c
+}
+
+func (c ChaosConfig) validate() error {
+	for _, a := range c.Actions {
+		switch a {
+		case chaosLatency, chaosLoss, chaosPartition, chaosBandwidth:
+		default:
+			return fmt.Errorf("unknown chaos action %q", a)
+		}
+	}
+	if c.MinInterval <= 0 || c.MinInterval > c.MaxInterval {
+		return fmt.Errorf("invalid chaos interval bounds %s-%s", c.MinInterval, c.MaxInterval)
+	}
+	if c.MinDuration <= 0 || c.MinDuration > c.MaxDuration {
+		return fmt.Errorf("invalid chaos duration bounds %s-%s", c.MinDuration, c.MaxDuration)
+	}
+	if c.MaxPartition < c.MinDuration {
+		return fmt.Errorf("chaos max partition %s is lower than the min duration %s", c.MaxPartition, c.MinDuration)
+	}
+	if c.MaxDelay < 10*time.Millisecond {
+		return fmt.Errorf("chaos max delay %s is lower than 10ms", c.MaxDelay)
+	}
+	if c.MaxLoss < 1 || c.MaxLoss > 100 {
+		return fmt.Errorf("chaos max loss %.1f%% is not between 1%% and 100%%", c.MaxLoss)
+	}
+	if c.MinRateKbit <= 0 || c.MinRateKbit > c.MaxRateKbit {
+		return fmt.Errorf("invalid chaos rate bounds %d-%d kbit", c.MinRateKbit, c.MaxRateKbit)
+	}
+	return nil
+}
+
+// chaosCmd represents the wan chaos command
+var chaosCmd = &cobra.Command{
+	Use:   "chaos",
+	Short: "Apply random impairments between the clusters",
+	Long: `Apply random impairments between the clusters.
+
+At random intervals a pair of clusters is picked and one of the actions is
+applied to both directions of the path for a random time: a latency spike, a
+loss burst, a short partition or a bandwidth drop. The bounds are defined in
+the chaos section of the config file, if passed.
+
+The actions are planned from the seed before starting, so a run is replayed
+exactly with the same seed, clusters, duration and bounds. Every action is
+logged with its offset from the start, and --dry-run only prints the plan.
+When the duration ends or the command is interrupted the links are restored
+to the ones defined in the config file, or the impairments are removed.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runChaos(cmd)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(chaosCmd)
+
+	chaosCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	chaosCmd.Flags().Int64(
+		"seed",
+		0,
+		"the seed of the random actions, a random seed is used if not set",
+	)
+	chaosCmd.Flags().Duration(
+		"duration",
+		30*time.Minute,
+		"time to run the chaos",
+	)
+	chaosCmd.Flags().String(
+		"config",
+		"",
+		"the config file with the chaos bounds and the links to restore",
+	)
+	chaosCmd.Flags().Bool(
+		"dry-run",
+		false,
+		"print the planned actions without applying them",
+	)
+}
+
+// chaosAction is an impairment applied to both directions of a path
+type chaosAction struct {
+	at         time.Duration
+	duration   time.Duration
+	kind       string
+	from       string
+	to         string
+	impairment Impairment
+}
+
+func (a chaosAction) String() string {
+	return fmt.Sprintf("%s %s <-> %s (%s) for %s", a.kind, a.from, a.to, impairmentString(a.impairment), a.duration)
+}
+
+// impairmentString returns the netem parameters of the impairment
+func impairmentString(imp Impairment) string {
+	return strings.Join(imp.netemArgs(), " ")
+}
+
+// planChaos returns the actions between the clusters, ordered by time. The random
+// values are always drawn in the same order so the plan only depends on the seed,
+// the clusters, the duration and the bounds. A pair of clusters has only one
+// action at a time, if the pair picked is busy the next free pair is used.
+func planChaos(seed int64, clusters []string, duration time.Duration, cfg ChaosConfig) []chaosAction {
+	r := rand.New(rand.NewSource(seed))
+	between := func(min, max time.Duration) time.Duration {
+		// the times are truncated to milliseconds to be readable in the logs
+		return (min + time.Duration(r.Int63n(int64(max-min)+1))).Truncate(time.Millisecond)
+	}
+
+	pairs := [][2]string{}
+	for i := range clusters {
+		for j := i + 1; j < len(clusters); j++ {
+			pairs = append(pairs, [2]string{clusters[i], clusters[j]})
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+	busy := make([]time.Duration, len(pairs))
+
+	actions := []chaosAction{}
+	at := time.Duration(0)
+	for {
+		at += between(cfg.MinInterval, cfg.MaxInterval)
+		if at >= duration {
+			return actions
+		}
+		picked := r.Intn(len(pairs))
+		kind := cfg.Actions[r.Intn(len(cfg.Actions))]
+		maxDuration := cfg.MaxDuration
+		if kind == chaosPartition && cfg.MaxPartition < maxDuration {
+			maxDuration = cfg.MaxPartition
+		}
+		a := chaosAction{
+			at:       at,
+			duration: between(cfg.MinDuration, maxDuration),
+			kind:     kind,
+		}
+		switch kind {
+		case chaosLatency:
+			delay := between(cfg.MaxDelay/10, cfg.MaxDelay).Round(time.Millisecond)
+			a.impairment = Impairment{
+				Delay:  fmt.Sprintf("%dms", delay.Milliseconds()),
+				Jitter: fmt.Sprintf("%dms", (delay / 10).Milliseconds()),
+			}
+		case chaosLoss:
+			a.impairment = Impairment{Loss: fmt.Sprintf("%.1f%%", 1+r.Float64()*(cfg.MaxLoss-1))}
+		case chaosPartition:
+			a.impairment = Impairment{Loss: "100%"}
+		case chaosBandwidth:
+			a.impairment = Impairment{Rate: fmt.Sprintf("%dkbit", cfg.MinRateKbit+r.Intn(cfg.MaxRateKbit-cfg.MinRateKbit+1))}
+		}
+		if at+a.duration > duration {
+			a.duration = duration - at
+		}
+
+		for i := 0; i < len(pairs); i++ {
+			p := (picked + i) % len(pairs)
+			if busy[p] <= at {
+				a.from, a.to = pairs[p][0], pairs[p][1]
+				busy[p] = at + a.duration
+				actions = append(actions, a)
+				break
+			}
+		}
+	}
+}
+
+func runChaos(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	seed, err := cmd.Flags().GetInt64("seed")
+	if err != nil {
+		return err
+	}
+	duration, err := cmd.Flags().GetDuration("duration")
+	if err != nil {
+		return err
+	}
+	configPath, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return err
+	}
+	dryRun, err := cmd.Flags().GetBool("dry-run")
+	if err != nil {
+		return err
+	}
+	// any seed can be replayed, including 0
+	if !cmd.Flags().Changed("seed") {
+		seed = time.Now().UnixNano()
+	}
+
+	cfg := &Config{}
+	if configPath != "" {
+		cfg, err = NewConfig(configPath)
+		if err != nil {
+			return err
+		}
+	}
+	bounds := cfg.Chaos.withDefaults()
+	if err := bounds.validate(); err != nil {
+		return err
+	}
+
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	clusters := []string{}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return err
+		}
+		if clusterName, ok := labels[docker.ClusterLabel]; ok {
+			clusters = append(clusters, clusterName)
+		}
+	}
+	sort.Strings(clusters)
+	if len(clusters) < 2 {
+		return fmt.Errorf("multicluster %s needs at least two clusters for chaos", name)
+	}
+
+	logger := kindcmd.NewLogger()
+	actions := planChaos(seed, clusters, duration, bounds)
+	logger.V(0).Infof("Chaos seed %d, %d actions in %s between clusters %v", seed, len(actions), duration, clusters)
+	if dryRun {
+		for _, a := range actions {
+			logger.V(0).Infof("[+%s] %s", a.at, a)
+		}
+		return nil
+	}
+
+	// the steps apply and restore the actions, the restores first if they are at the same time
+	type step struct {
+		at      time.Duration
+		restore bool
+		action  chaosAction
+	}
+	steps := []step{}
+	for _, a := range actions {
+		steps = append(steps, step{at: a.at, action: a}, step{at: a.at + a.duration, restore: true, action: a})
+	}
+	sort.SliceStable(steps, func(i, j int) bool {
+		if steps[i].at == steps[j].at {
+			return steps[i].restore && !steps[j].restore
+		}
+		return steps[i].at < steps[j].at
+	})
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	active := map[[2]string]chaosAction{}
+	// restore the links with active actions when the chaos ends, even if interrupted
+	defer func() {
+		for pair := range active {
+			if err := restoreLinks(name, pair[0], pair[1], cfg.Links); err != nil {
+				logger.Warnf("Failed to restore the links between %s and %s: %v", pair[0], pair[1], err)
+			}
+		}
+	}()
+
+	start := time.Now()
+	for _, s := range steps {
+		select {
+		case <-ctx.Done():
+			logger.V(0).Infof("[+%s] Chaos interrupted, restoring the links", time.Since(start).Round(time.Second))
+			return nil
+		case <-time.After(time.Until(start.Add(s.at))):
+		}
+		pair := [2]string{s.action.from, s.action.to}
+		if s.restore {
+			logger.V(0).Infof("[+%s] restore %s <-> %s", s.at, s.action.from, s.action.to)
+			if err := restoreLinks(name, s.action.from, s.action.to, cfg.Links); err != nil {
+				return errors.Wrapf(err, "failed to restore the links between %s and %s", s.action.from, s.action.to)
+			}
+			delete(active, pair)
+			continue
+		}
+		logger.V(0).Infof("[+%s] %s", s.at, s.action)
+		active[pair] = s.action
+		if err := setLinkImpairment(name, s.action.from, s.action.to, s.action.impairment); err != nil {
+			return errors.Wrapf(err, "failed to apply %s", s.action)
+		}
+		if err := setLinkImpairment(name, s.action.to, s.action.from, s.action.impairment); err != nil {
+			return errors.Wrapf(err, "failed to apply %s", s.action)
+		}
+	}
+	logger.V(0).Infof("Chaos finished, replay it with --seed %d --duration %s", seed, duration)
+	return nil
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanChaosReplay(t *testing.T) {
+	defaults := ChaosConfig{}.withDefaults()
+	tests := []struct {
+		name     string
+		seed     int64
+		clusters []string
+		duration time.Duration
+		bounds   ChaosConfig
+	}{
+		{
+			name:     "defaults",
+			seed:     42,
+			clusters: []string{"cluster-eu", "cluster-us"},
+			duration: 30 * time.Minute,
+			bounds:   defaults,
+		},
+		{
+			name:     "seed 0",
+			seed:     0,
+			clusters: []string{"cluster-ap", "cluster-eu", "cluster-us"},
+			duration: time.Hour,
+			bounds:   defaults,
+		},
+		{
+			name:     "negative seed",
+			seed:     -7,
+			clusters: []string{"cluster-ap", "cluster-eu", "cluster-us"},
+			duration: time.Hour,
+			bounds:   defaults,
+		},
+		{
+			name:     "partitions",
+			seed:     1234,
+			clusters: []string{"a", "b", "c", "d"},
+			duration: 2 * time.Hour,
+			bounds: ChaosConfig{
+				Actions:     []string{chaosPartition},
+				MinInterval: time.Second,
+				MaxInterval: 5 * time.Second,
+			}.withDefaults(),
+		},
+		{
+			name:     "single action bounds",
+			seed:     99,
+			clusters: []string{"a", "b"},
+			duration: 10 * time.Minute,
+			bounds: ChaosConfig{
+				Actions:     []string{chaosBandwidth, chaosLatency},
+				MinInterval: time.Second,
+				MaxInterval: time.Second,
+				MinDuration: 3 * time.Second,
+				MaxDuration: 3 * time.Second,
+				MinRateKbit: 500,
+				MaxRateKbit: 500,
+			}.withDefaults(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.bounds.validate(); err != nil {
+				t.Fatal(err)
+			}
+			plan := planChaos(tt.seed, tt.clusters, tt.duration, tt.bounds)
+			if len(plan) == 0 {
+				t.Fatal("empty plan")
+			}
+			for i := 0; i < 3; i++ {
+				replay := planChaos(tt.seed, tt.clusters, tt.duration, tt.bounds)
+				if !reflect.DeepEqual(plan, replay) {
+					t.Fatalf("the plan of seed %d is not replayed", tt.seed)
+				}
+			}
+			other := planChaos(tt.seed+1, tt.clusters, tt.duration, tt.bounds)
+			if reflect.DeepEqual(plan, other) {
+				t.Errorf("seeds %d and %d have the same plan", tt.seed, tt.seed+1)
+			}
+		})
+	}
+}
+
+func TestPlanChaosBounds(t *testing.T) {
+	clusters := []string{"cluster-ap", "cluster-eu", "cluster-us"}
+	duration := 4 * time.Hour
+	bounds := ChaosConfig{
+		MinInterval: time.Second,
+		MaxInterval: 10 * time.Second,
+	}.withDefaults()
+	for seed := int64(0); seed < 50; seed++ {
+		plan := planChaos(seed, clusters, duration, bounds)
+		// the end of the last action of each pair
+		busy := map[[2]string]time.Duration{}
+		prev := time.Duration(0)
+		for _, a := range plan {
+			if a.at < prev {
+				t.Fatalf("seed %d: actions not ordered by time: %s after %s", seed, a.at, prev)
+			}
+			prev = a.at
+			if a.at+a.duration > duration {
+				t.Errorf("seed %d: action %s ends after the chaos", seed, a)
+			}
+			if a.from >= a.to {
+				t.Errorf("seed %d: unexpected pair %s %s", seed, a.from, a.to)
+			}
+			pair := [2]string{a.from, a.to}
+			if end, ok := busy[pair]; ok && a.at < end {
+				t.Fatalf("seed %d: action %s at %s overlaps the previous action of the pair, that ends at %s", seed, a, a.at, end)
+			}
+			busy[pair] = a.at + a.duration
+			maxDuration := bounds.MaxDuration
+			if a.kind == chaosPartition {
+				maxDuration = bounds.MaxPartition
+			}
+			if a.duration > maxDuration {
+				t.Errorf("seed %d: action %s is longer than %s", seed, a, maxDuration)
+			}
+		}
+	}
+}
+
+func TestPlanChaosSingleCluster(t *testing.T) {
+	if plan := planChaos(1, []string{"cluster-eu"}, time.Hour, ChaosConfig{}.withDefaults()); len(plan) != 0 {
+		t.Errorf("expected no actions with one cluster, got %d", len(plan))
+	}
+}
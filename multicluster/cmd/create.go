@@ -16,7 +16,12 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aojea/kind-networking-plugins/pkg/docker"
 	"github.com/aojea/kind-networking-plugins/pkg/network"
@@ -30,11 +35,70 @@ import (
 	"sigs.k8s.io/kind/pkg/exec"
 )
 
-const dockerWanImage = "quay.io/aojea/wanem:latest"
+const (
+	dockerWanImage = "quay.io/aojea/wanem:latest"
+	// dockerWanHAImage is the WAN emulator image with keepalived, it is not
+	// published, make images builds it, the highly available WAN uses it
+	dockerWanHAImage = "kind-networking-plugins/wanem:v1"
+	// pluginName is used to label the resources owned by the plugin
+	pluginName = "multicluster"
+	// podSubnetLabel and serviceSubnetLabel record the cluster subnets
+	// in the cluster network so they can be obtained without the config
+	podSubnetLabel     = "io.x-k8s.kind-networking-plugins.pod-subnet"
+	serviceSubnetLabel = "io.x-k8s.kind-networking-plugins.service-subnet"
+)
 
 // Config struct for multicluster config
 type Config struct {
 	Clusters map[string]ClusterConfig `yaml:"clusters"`
+	// Mode defines how the clusters are connected, each cluster in its own
+	// network routed by the WAN emulator, the default, or all the clusters
+	// in one flat network with direct routes between them
+	Mode string `yaml:"mode,omitempty"`
+	// Flat defines the shared network of the flat mode
+	Flat FlatConfig `yaml:"flat,omitempty"`
+	// Sites defines external hosts attached to the WAN, each in its own network
+	Sites map[string]SiteConfig `yaml:"sites,omitempty"`
+	// Links defines the impairments of the traffic between clusters
+	Links []LinkConfig `yaml:"links,omitempty"`
+	// Profiles defines named impairments used by the benchmarks
+	Profiles map[string]Impairment `yaml:"profiles,omitempty"`
+	// Wan defines the WAN emulator options
+	Wan WanConfig `yaml:"wan,omitempty"`
+	// Interconnect defines how the traffic between clusters is forwarded,
+	// routed by the WAN emulator, the default, or through wireguard, vxlan
+	// or gre tunnels between edge gateways
+	Interconnect string `yaml:"interconnect,omitempty"`
+	// Topology defines which clusters can talk directly, all of them or
+	// only the hubs with the spokes
+	Topology TopologyConfig `yaml:"topology,omitempty"`
+	// Firewall defines the rules of the traffic allowed between clusters
+	Firewall []FirewallRule `yaml:"firewall,omitempty"`
+	// Proxy defines the HTTP proxy the clusters use to reach internet
+	Proxy ProxyConfig `yaml:"proxy,omitempty"`
+	// Egress defines the public network used by the clusters to reach internet
+	Egress EgressConfig `yaml:"egress,omitempty"`
+	// Chaos defines the bounds of the random impairments of the chaos mode
+	Chaos ChaosConfig `yaml:"chaos,omitempty"`
+}
+
+// WanConfig defines the WAN emulator options
+type WanConfig struct {
+	// HA creates a backup router that takes over the gateway IPs
+	// of the clusters networks if the primary router fails
+	HA bool `yaml:"ha,omitempty"`
+	// RenameInterfaces names the interfaces of the routers facing the
+	// clusters after the clusters, so the links can be addressed by cluster
+	RenameInterfaces bool `yaml:"renameInterfaces,omitempty"`
+}
+
+// image returns the image of the routers, the highly available WAN
+// requires keepalived
+func (w WanConfig) image() string {
+	if w.HA {
+		return dockerWanHAImage
+	}
+	return dockerWanImage
 }
 
 type ClusterConfig struct {
@@ -42,6 +106,94 @@ type ClusterConfig struct {
 	NodeSubnet    string `yaml:"nodeSubnet"`
 	PodSubnet     string `yaml:"podSubnet"`
 	ServiceSubnet string `yaml:"serviceSubnet"`
+	// EgressIP is the public address of the cluster traffic, it has
+	// to belong to the egress subnet
+	EgressIP string `yaml:"egressIP,omitempty"`
+	// Cluster is an optional KIND cluster spec, the name and the
+	// networking fields controlled by the plugin are merged on it
+	Cluster *v1alpha4.Cluster `yaml:"cluster,omitempty"`
+}
+
+// kindConfig returns the KIND configuration of the cluster merging the
+// cluster spec, if any, with the fields controlled by the plugin
+func (c ClusterConfig) kindConfig(name string) (*v1alpha4.Cluster, error) {
+	ipFamily, err := c.ipFamily()
+	if err != nil {
+		return nil, err
+	}
+	config := &v1alpha4.Cluster{}
+	if c.Cluster != nil {
+		config = c.Cluster.DeepCopy()
+	}
+
+	if config.Name != "" && config.Name != name {
+		return nil, fmt.Errorf("cluster spec name %s does not match %s", config.Name, name)
+	}
+	config.Name = name
+
+	// the nodes in the spec take precedence over the number of nodes
+	if len(config.Nodes) == 0 {
+		config.Nodes = createNodes(c.Nodes)
+	} else if c.Nodes != 0 && c.Nodes != len(config.Nodes) {
+		return nil, fmt.Errorf("cluster spec has %d nodes and %d were requested", len(config.Nodes), c.Nodes)
+	}
+
+	// the subnets are controlled by the plugin because the
+	// WAN emulator routes are based on them
+	networking := &config.Networking
+	if networking.IPFamily != "" && networking.IPFamily != ipFamily {
+		return nil, fmt.Errorf("cluster spec ipFamily %s does not match the subnets family %s", networking.IPFamily, ipFamily)
+	}
+	if networking.PodSubnet != "" && networking.PodSubnet != c.PodSubnet {
+		return nil, fmt.Errorf("cluster spec podSubnet %s does not match %s", networking.PodSubnet, c.PodSubnet)
+	}
+	if networking.ServiceSubnet != "" && networking.ServiceSubnet != c.ServiceSubnet {
+		return nil, fmt.Errorf("cluster spec serviceSubnet %s does not match %s", networking.ServiceSubnet, c.ServiceSubnet)
+	}
+	networking.IPFamily = ipFamily
+	networking.PodSubnet = c.PodSubnet
+	networking.ServiceSubnet = c.ServiceSubnet
+	return config, nil
+}
+
+// ipFamily returns the IP family of the cluster based on the subnets
+// configured, all the subnets must belong to the same IP families
+func (c ClusterConfig) ipFamily() (v1alpha4.ClusterIPFamily, error) {
+	var family v1alpha4.ClusterIPFamily
+	for _, subnets := range []string{c.NodeSubnet, c.PodSubnet, c.ServiceSubnet} {
+		f, err := subnetsIPFamily(subnets)
+		if err != nil {
+			return "", err
+		}
+		if family != "" && f != family {
+			return "", fmt.Errorf("subnets %s are %s and expected %s", subnets, f, family)
+		}
+		family = f
+	}
+	return family, nil
+}
+
+// subnetsIPFamily returns the IP family of a comma separated list of subnets
+func subnetsIPFamily(subnets string) (v1alpha4.ClusterIPFamily, error) {
+	ipv4, ipv6 := false, false
+	for _, s := range strings.Split(subnets, ",") {
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return "", err
+		}
+		if network.IsIPv6CIDR(s) {
+			ipv6 = true
+		} else {
+			ipv4 = true
+		}
+	}
+	switch {
+	case ipv4 && ipv6:
+		return v1alpha4.DualStackFamily, nil
+	case ipv6:
+		return v1alpha4.IPv6Family, nil
+	default:
+		return v1alpha4.IPv4Family, nil
+	}
 }
 
 // NewConfig returns a new decoded Config struct
@@ -75,7 +227,9 @@ var createCmd = &cobra.Command{
 passed as parameters.
 
 Multicluster deployment create KIND clusters in independent bridges, that are connected
-through an special container that handles the routing and the WAN emulation.`,
+through an special container that handles the routing and the WAN emulation.
+In flat mode the KIND clusters share one bridge, and the nodes have routes to the
+pods and services of the other clusters.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return configureMultiCluster(cmd)
 	},
@@ -96,6 +250,27 @@ func init() {
 		"the config file with the cluster configuration",
 	)
 	createCmd.MarkFlagRequired("config")
+
+	createCmd.Flags().StringSlice(
+		"images",
+		[]string{},
+		"image tarballs or local images loaded in the nodes, the images of the multicluster have to be local or loaded",
+	)
+	createCmd.Flags().Bool(
+		"airgap",
+		false,
+		"create the clusters without egress, with a local registry mirror",
+	)
+	createCmd.Flags().StringSlice(
+		"airgap-images",
+		[]string{},
+		"image tarballs, as created by docker save, pushed to the registry mirror",
+	)
+	createCmd.Flags().String(
+		"registry-image",
+		defaultRegistryImage,
+		"the image of the registry mirror, it has to be available in the host",
+	)
 }
 
 func configureMultiCluster(cmd *cobra.Command) error {
@@ -107,17 +282,129 @@ func configureMultiCluster(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	imageArgs, err := cmd.Flags().GetStringSlice("images")
+	if err != nil {
+		return err
+	}
+	airgap, err := cmd.Flags().GetBool("airgap")
+	if err != nil {
+		return err
+	}
+	airgapImages, err := cmd.Flags().GetStringSlice("airgap-images")
+	if err != nil {
+		return err
+	}
+	registryImage, err := cmd.Flags().GetString("registry-image")
+	if err != nil {
+		return err
+	}
 	cfg, err := NewConfig(configPath)
 	if err != nil {
 		return err
 	}
 
+	// the clusters are created in order so the router interfaces
+	// are the same each time the multicluster is created
+	clusterNames := make([]string, 0, len(cfg.Clusters))
+	for clusterName := range cfg.Clusters {
+		clusterNames = append(clusterNames, clusterName)
+	}
+	sort.Strings(clusterNames)
+
+	// validate the clusters configuration before creating anything
+	if err := validateMode(cfg); err != nil {
+		return err
+	}
+	for _, clusterName := range clusterNames {
+		if _, err := cfg.Clusters[clusterName].kindConfig(clusterName); err != nil {
+			return errors.Wrapf(err, "invalid configuration for cluster %s", clusterName)
+		}
+	}
+	// the sites are created after the clusters, in order too
+	siteNames := make([]string, 0, len(cfg.Sites))
+	for siteName := range cfg.Sites {
+		siteNames = append(siteNames, siteName)
+	}
+	sort.Strings(siteNames)
+	if err := validateSites(cfg); err != nil {
+		return err
+	}
+	if cfg.Wan.RenameInterfaces {
+		if err := validateRenameInterfaces(append(clusterNames, siteNames...)); err != nil {
+			return err
+		}
+	}
+	if err := validateInterconnect(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Topology.validate(cfg.Clusters); err != nil {
+		return errors.Wrap(err, "invalid topology")
+	}
+	if err := validateEgress(cfg); err != nil {
+		return err
+	}
+	if err := cfg.Proxy.validate(); err != nil {
+		return errors.Wrap(err, "invalid proxy")
+	}
+	if airgap {
+		if err := validateAirgap(cfg); err != nil {
+			return err
+		}
+	}
+	for i, r := range cfg.Firewall {
+		if err := r.validate(cfg.Clusters); err != nil {
+			return errors.Wrapf(err, "invalid firewall rule %d", i+1)
+		}
+	}
+	// load the images before creating anything, so
+	// creating the multicluster offline fails fast
+	images := []string{}
+	if len(imageArgs) > 0 {
+		images, err = docker.LoadImages(imageArgs)
+		if err != nil {
+			return err
+		}
+		required, err := requiredImages(cfg, clusterNames, airgap, registryImage)
+		if err != nil {
+			return err
+		}
+		if err := docker.CheckImages(required); err != nil {
+			return err
+		}
+	}
+	if cfg.Mode == flatMode {
+		return createFlatMultiCluster(name, cfg, clusterNames, images)
+	}
+	if cfg.Wan.HA && !docker.ImageExists(cfg.Wan.image()) {
+		return fmt.Errorf("the highly available WAN requires the image %s with keepalived, build it with make images", cfg.Wan.image())
+	}
+	if cfg.Proxy.Enabled && !docker.ImageExists(dockerProxyImage) {
+		return fmt.Errorf("the HTTP proxy requires the image %s, build it with make images", dockerProxyImage)
+	}
+
 	// create the container to emulate the WAN network
-	wanem := "wan-" + name
-	err = createWanem(name)
+	// and its backup if the WAN is highly available
+	err = createWanem(name, "wan-"+name, cfg, airgap)
 	if err != nil {
 		return err
 	}
+	if cfg.Wan.HA {
+		err = createWanem(name, "wan-"+name+"-backup", cfg, airgap)
+		if err != nil {
+			return err
+		}
+	}
+	// the clusters are connected to the registry mirror when they are created
+	if airgap {
+		if err := createRegistry(name, registryImage, airgapImages); err != nil {
+			return err
+		}
+	}
+	if cfg.Egress.Subnet != "" {
+		if err := createPublicNetwork(name, cfg.Egress); err != nil {
+			return err
+		}
+	}
 
 	// create the clusters
 	logger := kindcmd.NewLogger()
@@ -125,94 +412,265 @@ func configureMultiCluster(cmd *cobra.Command) error {
 		cluster.ProviderWithLogger(logger),
 	)
 
-	for clusterName, clusterConfig := range cfg.Clusters {
-		// each cluster has its own docker network with the clustername
-		subnet := clusterConfig.NodeSubnet
-		err := docker.CreateNetwork(clusterName, subnet, false)
+	for _, clusterName := range clusterNames {
+		err := createMemberCluster(provider, name, clusterName, cfg.Clusters[clusterName], cfg.Topology.labels(clusterName))
 		if err != nil {
 			return err
 		}
-		// connect wanem with the last IP of the range
-		// that the cluster will use later as gateway
-		gateway, err := network.GetLastIPSubnet(subnet)
-		if err != nil {
+	}
+	if err := loadClusterImages(provider, clusterNames, images); err != nil {
+		return err
+	}
+	for _, siteName := range siteNames {
+		if err := createSite(name, siteName, cfg.Sites[siteName]); err != nil {
 			return err
 		}
-		err = docker.ConnectNetwork(wanem, clusterName, gateway.String())
-		if err != nil {
+	}
+	// configure the topology, the impairments and the firewall between the clusters
+	if err := applyTopology(provider, name); err != nil {
+		return err
+	}
+	if err := configureAPIServers(provider, name); err != nil {
+		return err
+	}
+	if err := applyLinks(name, cfg.Links); err != nil {
+		return err
+	}
+	if err := applyFirewall(name); err != nil {
+		return err
+	}
+	// the clusters are created with direct access to internet
+	// so the node images can be pulled, it is blocked at the end
+	if cfg.Proxy.Enabled {
+		return configureProxy(provider, name)
+	}
+	return nil
+}
+
+// createMemberCluster creates a KIND cluster in its own docker network and
+// connects it to the WAN emulator of the multicluster, the topology labels
+// record the role of the cluster in the topology
+func createMemberCluster(provider *cluster.Provider, name, clusterName string, clusterConfig ClusterConfig, topologyLabels map[string]string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	rename, err := wanRenameInterfaces(name)
+	if err != nil {
+		return err
+	}
+	// each cluster has its own docker network with the clustername
+	// labeled with the owner so get and delete can find it later
+	subnet := clusterConfig.NodeSubnet
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{
+			docker.ClusterLabel: clusterName,
+			podSubnetLabel:      clusterConfig.PodSubnet,
+			serviceSubnetLabel:  clusterConfig.ServiceSubnet,
+		},
+		topologyLabels,
+	)
+	if clusterConfig.EgressIP != "" {
+		labels[egressIPLabel] = clusterConfig.EgressIP
+	}
+	err = docker.CreateNetwork(clusterName, subnet, false, labels)
+	if err != nil {
+		return err
+	}
+	// the nodes reach the registry mirror of the air-gapped multicluster by name
+	registry, mirrors, err := airgapRegistry(name)
+	if err != nil {
+		return err
+	}
+	if registry != "" {
+		if err := docker.ConnectNetwork(registry, clusterName); err != nil {
 			return err
 		}
-		// use the new created docker network
-		os.Setenv("KIND_EXPERIMENTAL_DOCKER_NETWORK", clusterName)
-		podSubnet := clusterConfig.PodSubnet
-		svcSubnet := clusterConfig.ServiceSubnet
-		config := &v1alpha4.Cluster{
-			Name:  clusterName,
-			Nodes: createNodes(clusterConfig.Nodes),
-			Networking: v1alpha4.Networking{
-				PodSubnet:     podSubnet,
-				ServiceSubnet: svcSubnet,
-			},
-		}
-
-		// create the cluster
-		if err := provider.Create(
-			clusterName,
-			cluster.CreateWithV1Alpha4Config(config),
-			// cluster.CreateWithNodeImage(flags.ImageName),
-			// cluster.CreateWithRetain(flags.Retain),
-			// cluster.CreateWithWaitForReady(flags.Wait),
-			// cluster.CreateWithKubeconfigPath(flags.Kubeconfig),
-			cluster.CreateWithDisplayUsage(true),
-			cluster.CreateWithDisplaySalutation(true),
-		); err != nil {
-			return errors.Wrap(err, "failed to create cluster")
-		}
-		// reset the env variable
-		os.Unsetenv("KIND_EXPERIMENTAL_DOCKER_NETWORK")
-		// change the default network in all nodes
-		// to use the wanem container and provide
-		// connectivity between clusters
-		nodes, err := provider.ListNodes(clusterName)
-		if err != nil {
+	}
+	// the cluster will use the last IP of the range of each IP family
+	// as gateway, owned by wanem, shared by the routers of the HA WAN
+	// or owned by the edge gateway of the cluster
+	gateways, err := routerAddresses(subnet, 0, false)
+	if err != nil {
+		return err
+	}
+	ha := len(routers) > 1
+	tunnel := interconnect != routedInterconnect
+	if err := connectRouters(routers, clusterName, subnet, tunnel, rename); err != nil {
+		return err
+	}
+	if ha {
+		if err := configureVRRP(name); err != nil {
+			return err
+		}
+	}
+	if tunnel {
+		if err := createEdgeGateway(name, clusterName, interconnect); err != nil {
 			return err
 		}
-		for _, n := range nodes {
-			err := docker.ReplaceGateway(n.String(), gateway.String())
+		if err := configureTunnels(name); err != nil {
+			return err
+		}
+	}
+	// use the new created docker network
+	os.Setenv("KIND_EXPERIMENTAL_DOCKER_NETWORK", clusterName)
+	podSubnet := clusterConfig.PodSubnet
+	svcSubnet := clusterConfig.ServiceSubnet
+	config, err := clusterConfig.kindConfig(clusterName)
+	if err != nil {
+		return errors.Wrapf(err, "invalid configuration for cluster %s", clusterName)
+	}
+	if len(mirrors) > 0 {
+		config.ContainerdConfigPatches = append(config.ContainerdConfigPatches, registryMirrorsPatch(registry, mirrors))
+	}
+	// the API server is reachable from the other clusters at the gateways
+	patch, err := apiServerCertSANsPatch(gateways)
+	if err != nil {
+		return err
+	}
+	config.KubeadmConfigPatchesJSON6902 = append(config.KubeadmConfigPatchesJSON6902, patch)
+
+	// create the cluster
+	if err := provider.Create(
+		clusterName,
+		cluster.CreateWithV1Alpha4Config(config),
+		// cluster.CreateWithNodeImage(flags.ImageName),
+		// cluster.CreateWithRetain(flags.Retain),
+		// cluster.CreateWithWaitForReady(flags.Wait),
+		// cluster.CreateWithKubeconfigPath(flags.Kubeconfig),
+		cluster.CreateWithDisplayUsage(true),
+		cluster.CreateWithDisplaySalutation(true),
+	); err != nil {
+		return errors.Wrap(err, "failed to create cluster")
+	}
+	// reset the env variable
+	os.Unsetenv("KIND_EXPERIMENTAL_DOCKER_NETWORK")
+	// change the default network in all nodes
+	// to use the wanem container and provide
+	// connectivity between clusters
+	nodes, err := provider.ListNodes(clusterName)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		for _, gateway := range gateways {
+			err := docker.ReplaceGateway(n.String(), gateway)
 			if err != nil {
 				return err
 			}
 		}
-		// insert routes in wanem to reach services through one of the nodes
-		ipv4, _, err := nodes[0].IP()
+	}
+	// insert routes in wanem, or in the edge gateway, to reach services through
+	// one of the nodes using the node IP of the same family than the subnet, the
+	// external load balancer of the clusters with multiple control planes is not valid
+	nodes, err = internalNodes(provider, clusterName)
+	if err != nil {
+		return err
+	}
+	ipv4, ipv6, err := nodes[0].IP()
+	if err != nil {
+		return err
+	}
+	subnets := append(strings.Split(svcSubnet, ","), strings.Split(podSubnet, ",")...)
+	for _, s := range subnets {
+		gateway := ipv4
+		if network.IsIPv6CIDR(s) {
+			gateway = ipv6
+		}
+		if tunnel {
+			err = addRoutesEdge(clusterName, gateway, s)
+		} else {
+			err = addRoutesWanem(name, gateway, s)
+		}
 		if err != nil {
 			return err
 		}
-		err = addRoutesWanem(name, ipv4, svcSubnet, podSubnet)
+	}
+	// translate the cluster traffic to its public egress IP
+	if clusterConfig.EgressIP != "" {
+		return configureClusterEgress(name, clusterName, clusterConfig.EgressIP)
+	}
+	return nil
+}
+
+// connectRouters connects the WAN routers to the network, the interfaces
+// are renamed after the network if rename is set. The gateway IPs are shared
+// by the routers of the HA WAN or owned by the edge gateway of the cluster.
+func connectRouters(routers []string, networkName, subnet string, edge, rename bool) error {
+	ha := len(routers) > 1
+	for i, router := range routers {
+		ips, err := routerAddresses(subnet, i, ha || edge)
 		if err != nil {
 			return err
 		}
-
+		err = docker.ConnectNetwork(router, networkName, ips...)
+		if err != nil {
+			return err
+		}
+		if rename {
+			if err := renameRouterInterface(router, networkName, networkName); err != nil {
+				return err
+			}
+		}
+		info, err := routerInterfaceInfo(router, networkName)
+		if err != nil {
+			return err
+		}
+		kindcmd.NewLogger().V(0).Infof("Network %s connected to router %s interface %s MAC %s host interface %s",
+			networkName, router, info.Interface, info.MAC, info.HostInterface)
 	}
 	return nil
 }
 
-func createWanem(name string) error {
-	containerName := "wan-" + name
+// createWanem runs a WAN router, the router masquerades the traffic of the
+// clusters to internet unless the multicluster is air-gapped
+func createWanem(name, containerName string, cfg *Config, airgap bool) error {
 	args := []string{"run",
 		"-d", // run in the background
 		"--sysctl=net.ipv4.ip_forward=1",
 		"--sysctl=net.ipv4.conf.all.rp_filter=0",
+		"--sysctl=net.ipv6.conf.all.disable_ipv6=0",
+		"--sysctl=net.ipv6.conf.all.forwarding=1",
 		"--privileged",
 		"--name", containerName, // well known name
-		dockerWanImage,
 	}
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{
+			docker.RoleLabel:      routerRole,
+			interconnectLabel:     cfg.Interconnect,
+			renameInterfacesLabel: strconv.FormatBool(cfg.Wan.RenameInterfaces),
+		},
+	)
+	if cfg.Proxy.Enabled {
+		labels[proxyPortLabel] = strconv.Itoa(cfg.Proxy.port())
+	}
+	if airgap {
+		labels[airgapLabel] = "true"
+	}
+	rules, err := firewallRulesLabel(cfg.Firewall)
+	if err != nil {
+		return err
+	}
+	if rules != "" {
+		labels[firewallLabel] = rules
+	}
+	args = append(args, docker.LabelArgs(labels)...)
+	args = append(args, cfg.Wan.image())
 
 	cmd := exec.Command("docker", args...)
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
+	if airgap {
+		return blockEgress(containerName, "egress blocked by the airgap")
+	}
 	// configure masquerading so clusters can reach internet
 	args = []string{"exec", containerName,
 		"iptables", "-t", "nat", "-A", "POSTROUTING", "-o", "eth0", "-j", "MASQUERADE",
@@ -222,13 +680,19 @@ func createWanem(name string) error {
 }
 
 func addRoutesWanem(name, gateway string, subnets ...string) error {
-	for _, subnet := range subnets {
-		args := []string{"exec", "wan-" + name,
-			"ip", "route", "add", subnet, "via", gateway,
-		}
-		cmd := exec.Command("docker", args...)
-		if err := cmd.Run(); err != nil {
-			return err
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	for _, router := range routers {
+		for _, subnet := range subnets {
+			args := []string{"exec", router,
+				"ip", "route", "add", subnet, "via", gateway,
+			}
+			cmd := exec.Command("docker", args...)
+			if err := cmd.Run(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -16,14 +16,11 @@ limitations under the License.
 package cmd
 
 import (
-	"strings"
-
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 
 	"sigs.k8s.io/kind/pkg/cluster"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
-	"sigs.k8s.io/kind/pkg/exec"
 
 	"github.com/aojea/kind-networking-plugins/pkg/docker"
 )
@@ -32,7 +29,10 @@ import (
 var deleteCmd = &cobra.Command{
 	Use:   "delete",
 	Short: "Delete the specified multicluster",
-	Long:  `Delete the specified multicluster`,
+	Long: `Delete the specified multicluster.
+
+The clusters, networks and WAN emulator are found using the owner labels
+set when the multicluster was created, so the config file is not needed.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return deleteMultiCluster(cmd)
 	},
@@ -52,7 +52,7 @@ func init() {
 		"./config.yml",
 		"the config file with the cluster configuration",
 	)
-	deleteCmd.MarkFlagRequired("config")
+	deleteCmd.Flags().MarkDeprecated("config", "resources are found using the owner labels")
 }
 
 func deleteMultiCluster(cmd *cobra.Command) error {
@@ -60,16 +60,7 @@ func deleteMultiCluster(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
-	configPath, err := cmd.Flags().GetString("config")
-	if err != nil {
-		return err
-	}
-	cfg, err := NewConfig(configPath)
-	if err != nil {
-		return err
-	}
 
-	deleteWanem(name)
 	logger := kindcmd.NewLogger()
 
 	provider := cluster.NewProvider(
@@ -80,35 +71,69 @@ func deleteMultiCluster(cmd *cobra.Command) error {
 		return err
 	}
 
-	for clusterName, _ := range cfg.Clusters {
-
-		for _, cluster := range clusters {
-			if strings.Contains(cluster, clusterName) {
-				if err = provider.Delete(cluster, ""); err != nil {
-					logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", cluster))
-					continue
-				}
-				logger.V(0).Infof("Deleted clusters: %q", cluster)
-			}
-		}
-		networks, err := docker.ListNetwork()
+	ownerLabels := docker.OwnerLabels(pluginName, name)
+	networks, err := docker.ListNetworksByLabel(ownerLabels)
+	if err != nil {
+		return err
+	}
+	// delete the clusters attached to the networks first
+	// so the networks don't have containers attached
+	for _, network := range networks {
+		labels, err := docker.GetNetworkLabels(network)
 		if err != nil {
 			return err
 		}
-		for _, network := range networks {
-			if strings.Contains(network, clusterName) {
-				if err = docker.DeleteNetwork(network); err != nil {
-					logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete network %q", network))
-					continue
-				}
+		for _, clusterLabels := range networkClusterLabels(labels) {
+			clusterName := clusterLabels[docker.ClusterLabel]
+			if !sliceContains(clusters, clusterName) {
+				continue
 			}
+			if err = provider.Delete(clusterName, ""); err != nil {
+				logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", clusterName))
+				continue
+			}
+			logger.V(0).Infof("Deleted clusters: %q", clusterName)
+		}
+	}
+
+	// the proxies share the network namespace of the routers so they are deleted first
+	ordered, err := docker.ListContainersByLabel(docker.MergeLabels(
+		ownerLabels,
+		map[string]string{docker.RoleLabel: proxyRole},
+	))
+	if err != nil {
+		return err
+	}
+	containers, err := docker.ListContainersByLabel(ownerLabels)
+	if err != nil {
+		return err
+	}
+	for _, container := range containers {
+		if !sliceContains(ordered, container) {
+			ordered = append(ordered, container)
+		}
+	}
+	for _, container := range ordered {
+		if err = docker.DeleteContainer(container); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete container %q", container))
+		}
+	}
+
+	for _, network := range networks {
+		if err = docker.DeleteNetwork(network); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete network %q", network))
+			continue
 		}
 	}
 	// TODO accumulate errors
 	return nil
 }
 
-func deleteWanem(name string) error {
-	containerName := "wan-" + name
-	return exec.Command("docker", "rm", "-f", containerName).Run()
+func sliceContains(slice []string, a string) bool {
+	for _, s := range slice {
+		if a == s {
+			return true
+		}
+	}
+	return false
 }
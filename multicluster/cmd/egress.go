@@ -0,0 +1,261 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// egressIPLabel records the public egress IP in the cluster network
+	egressIPLabel = "io.x-k8s.kind-networking-plugins.egress-ip"
+	// interClusterLabel records in the public network if the traffic
+	// between clusters uses the egress IPs too
+	interClusterLabel = "io.x-k8s.kind-networking-plugins.inter-cluster-snat"
+	publicRole        = "public"
+)
+
+// EgressConfig defines the emulated public network of the WAN emulator
+type EgressConfig struct {
+	// Subnet of the public network, the WAN emulator reaches internet
+	// through it instead of through the docker default bridge
+	Subnet string `yaml:"subnet,omitempty"`
+	// InterCluster translates the traffic between clusters to the
+	// egress IPs too, so the clusters see the public source addresses
+	InterCluster bool `yaml:"interCluster,omitempty"`
+}
+
+func publicNetworkName(name string) string {
+	return "public-" + name
+}
+
+// validateEgress validates the public network and the egress IPs of the clusters
+func validateEgress(cfg *Config) error {
+	if cfg.Egress.Subnet == "" {
+		for clusterName, c := range cfg.Clusters {
+			if c.EgressIP != "" {
+				return fmt.Errorf("cluster %s egressIP requires the egress subnet", clusterName)
+			}
+		}
+		if cfg.Egress.InterCluster {
+			return fmt.Errorf("egress interCluster requires the egress subnet")
+		}
+		return nil
+	}
+	_, subnet, err := net.ParseCIDR(cfg.Egress.Subnet)
+	if err != nil {
+		return err
+	}
+	// the routers of the HA WAN would announce the same egress IPs
+	if cfg.Wan.HA {
+		return fmt.Errorf("egress is not supported with a highly available WAN")
+	}
+	// the WAN emulator does not see the tunneled traffic between clusters
+	if cfg.Egress.InterCluster && cfg.Interconnect != "" && cfg.Interconnect != routedInterconnect {
+		return fmt.Errorf("egress interCluster is not supported with the %s interconnect", cfg.Interconnect)
+	}
+	// the first IP is the docker bridge and the last one the WAN emulator
+	gateway := network.AddIPOffset(subnet.IP, 1)
+	router, err := network.GetLastIPSubnet(cfg.Egress.Subnet)
+	if err != nil {
+		return err
+	}
+	used := map[string]string{}
+	for clusterName, c := range cfg.Clusters {
+		if c.EgressIP == "" {
+			continue
+		}
+		ip := net.ParseIP(c.EgressIP)
+		if ip == nil || !subnet.Contains(ip) {
+			return fmt.Errorf("cluster %s egressIP %s does not belong to the egress subnet %s", clusterName, c.EgressIP, subnet)
+		}
+		if ip.Equal(gateway) || ip.Equal(router) {
+			return fmt.Errorf("cluster %s egressIP %s is reserved", clusterName, c.EgressIP)
+		}
+		if other, ok := used[ip.String()]; ok {
+			return fmt.Errorf("clusters %s and %s have the same egressIP %s", clusterName, other, c.EgressIP)
+		}
+		used[ip.String()] = clusterName
+	}
+	return nil
+}
+
+// createPublicNetwork creates the public network and makes it the route to
+// internet of the WAN emulator, the traffic of the clusters without egress
+// IP is masqueraded to the WAN emulator address in the public network
+func createPublicNetwork(name string, egress EgressConfig) error {
+	public := publicNetworkName(name)
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{
+			docker.RoleLabel:  publicRole,
+			interClusterLabel: fmt.Sprintf("%t", egress.InterCluster),
+		},
+	)
+	// the docker host masquerades the public network to internet
+	if err := docker.CreateNetwork(public, egress.Subnet, true, labels); err != nil {
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(egress.Subnet)
+	if err != nil {
+		return err
+	}
+	address, err := network.GetLastIPSubnet(egress.Subnet)
+	if err != nil {
+		return err
+	}
+	wanem := "wan-" + name
+	if err := docker.ConnectNetwork(wanem, public, address.String()); err != nil {
+		return err
+	}
+	if err := docker.ReplaceGateway(wanem, network.AddIPOffset(subnet.IP, 1).String()); err != nil {
+		return err
+	}
+	iface, err := routerInterface(wanem, public)
+	if err != nil {
+		return err
+	}
+	err = exec.Command("docker", "exec", wanem, iptablesCmd(egress.Subnet),
+		"-t", "nat", "-A", "POSTROUTING", "-o", iface, "-j", "MASQUERADE").Run()
+	if err != nil {
+		return errors.Wrapf(err, "failed to masquerade the public network on %s", wanem)
+	}
+	return nil
+}
+
+// configureClusterEgress translates the traffic of the cluster to internet,
+// and to the other clusters if configured, to the egress IP of the cluster,
+// that is assigned to the WAN emulator interface in the public network
+func configureClusterEgress(name, clusterName, egressIP string) error {
+	wanem := "wan-" + name
+	public := publicNetworkName(name)
+	subnets, err := docker.GetNetworkSubnets(public)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the public network %s subnet", public)
+	}
+	if len(subnets) == 0 {
+		return fmt.Errorf("public network %s has no subnet", public)
+	}
+	labels, err := docker.GetNetworkLabels(public)
+	if err != nil {
+		return err
+	}
+	iface, err := routerInterface(wanem, public)
+	if err != nil {
+		return err
+	}
+	_, subnet, err := net.ParseCIDR(subnets[0])
+	if err != nil {
+		return err
+	}
+	ones, _ := subnet.Mask.Size()
+	err = exec.Command("docker", "exec", wanem, "ip", "addr", "add", fmt.Sprintf("%s/%d", egressIP, ones), "dev", iface).Run()
+	if err != nil {
+		return errors.Wrapf(err, "failed to add egress IP %s on %s", egressIP, wanem)
+	}
+
+	sources, err := clusterSourceSubnets(clusterName)
+	if err != nil {
+		return err
+	}
+	for _, source := range sources {
+		// the source must be of the same IP family than the egress IP
+		if network.IsIPv6CIDR(source) != network.IsIPv6CIDR(subnets[0]) {
+			continue
+		}
+		args := []string{"exec", wanem, iptablesCmd(source), "-t", "nat", "-I", "POSTROUTING", "-s", source}
+		if labels[interClusterLabel] != "true" {
+			args = append(args, "-o", iface)
+		}
+		args = append(args, "-m", "comment", "--comment", egressComment(clusterName), "-j", "SNAT", "--to-source", egressIP)
+		if err := exec.Command("docker", args...).Run(); err != nil {
+			return errors.Wrapf(err, "failed to configure egress IP %s on %s", egressIP, wanem)
+		}
+	}
+	return nil
+}
+
+// deleteClusterEgress removes the egress IP and the SNAT rules of the cluster
+func deleteClusterEgress(name, clusterName string) error {
+	labels, err := docker.GetNetworkLabels(clusterName)
+	if err != nil {
+		return err
+	}
+	egressIP := labels[egressIPLabel]
+	if egressIP == "" {
+		return nil
+	}
+	wanem := "wan-" + name
+	iptables := "iptables"
+	if net.ParseIP(egressIP).To4() == nil {
+		iptables = "ip6tables"
+	}
+	// output format: -A POSTROUTING -s 10.0.0.0/16 -m comment --comment multicluster-egress-cluster-eu -j SNAT --to-source 203.0.113.10
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", wanem, iptables, "-t", "nat", "-S", "POSTROUTING"))
+	if err != nil {
+		return err
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 2 || fields[0] != "-A" || !sliceContains(fields, egressComment(clusterName)) {
+			continue
+		}
+		args := append([]string{"exec", wanem, iptables, "-t", "nat", "-D"}, fields[1:]...)
+		if err := exec.Command("docker", args...).Run(); err != nil {
+			return errors.Wrapf(err, "failed to delete egress rule on %s", wanem)
+		}
+	}
+	iface, err := routerInterface(wanem, publicNetworkName(name))
+	if err != nil {
+		return err
+	}
+	// output format: 4: eth2    inet 203.0.113.10/24 scope global secondary eth2
+	addrs, err := exec.OutputLines(exec.Command("docker", "exec", wanem, "ip", "-o", "addr", "show", "dev", iface))
+	if err != nil {
+		return err
+	}
+	for _, l := range addrs {
+		fields := strings.Fields(l)
+		if len(fields) < 4 || !strings.HasPrefix(fields[3], egressIP+"/") {
+			continue
+		}
+		if err := exec.Command("docker", "exec", wanem, "ip", "addr", "del", fields[3], "dev", iface).Run(); err != nil {
+			return errors.Wrapf(err, "failed to delete egress IP %s on %s", egressIP, wanem)
+		}
+	}
+	return nil
+}
+
+func egressComment(clusterName string) string {
+	return "multicluster-egress-" + clusterName
+}
+
+// iptablesCmd returns the iptables command of the IP family of the subnet
+func iptablesCmd(subnet string) string {
+	if network.IsIPv6CIDR(subnet) {
+		return "ip6tables"
+	}
+	return "iptables"
+}
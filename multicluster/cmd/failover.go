@@ -0,0 +1,249 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+// failoverComment identifies the rules that blackhole the traffic of a failed router
+const failoverComment = "multicluster-failover"
+
+// failoverCmd represents the wan failover command
+var failoverCmd = &cobra.Command{
+	Use:   "failover",
+	Short: "Fail the active router of a highly available WAN",
+	Long: `Fail the active router of a highly available WAN.
+
+The active router stops announcing the gateway IPs and drops all the
+forwarded traffic, so the backup router takes over the gateway IPs.
+Use "wan recover" to bring the failed router back.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return failoverWan(cmd)
+	},
+}
+
+// recoverCmd represents the wan recover command
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "Recover the failed routers of a highly available WAN",
+	Long: `Recover the failed routers of a highly available WAN.
+
+The routers forward traffic again and announce the gateway IPs,
+the primary router takes back the gateway IPs because it has the
+highest priority.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return recoverWan(cmd)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(failoverCmd)
+	wanCmd.AddCommand(recoverCmd)
+
+	for _, c := range []*cobra.Command{failoverCmd, recoverCmd} {
+		c.Flags().String(
+			"name",
+			cluster.DefaultName,
+			"the multicluster context name",
+		)
+		c.Flags().Duration(
+			"timeout",
+			30*time.Second,
+			"time to wait for a router to take over the gateway IPs",
+		)
+	}
+}
+
+func failoverWan(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	routers, err := haRouters(name)
+	if err != nil {
+		return err
+	}
+	gateway, err := failoverGateway(name)
+	if err != nil {
+		return err
+	}
+	active, err := activeRouter(routers, gateway)
+	if err != nil {
+		return err
+	}
+	if active == "" {
+		return fmt.Errorf("no router owns the gateway IP %s", gateway)
+	}
+
+	logger := kindcmd.NewLogger()
+	start := time.Now()
+	// stopping keepalived releases the gateway IPs and the drop
+	// rules blackhole the traffic that still reaches the router
+	if err := stopVRRP(active); err != nil {
+		return err
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		err := exec.Command("docker", "exec", active, iptables, "-I", "FORWARD",
+			"-m", "comment", "--comment", failoverComment, "-j", "DROP").Run()
+		if err != nil {
+			return errors.Wrapf(err, "failed to drop forwarded traffic on %s", active)
+		}
+	}
+	logger.V(0).Infof("Failed router %s", active)
+
+	backup, err := waitActiveRouter(routers, active, gateway, timeout)
+	if err != nil {
+		return err
+	}
+	logger.V(0).Infof("Router %s took over gateway %s after %v", backup, gateway, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+func recoverWan(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	routers, err := haRouters(name)
+	if err != nil {
+		return err
+	}
+	gateway, err := failoverGateway(name)
+	if err != nil {
+		return err
+	}
+
+	logger := kindcmd.NewLogger()
+	start := time.Now()
+	for _, router := range routers {
+		for _, iptables := range []string{"iptables", "ip6tables"} {
+			rule := []string{"FORWARD", "-m", "comment", "--comment", failoverComment, "-j", "DROP"}
+			// delete all the drop rules, failover may run multiple times
+			for exec.Command("docker", append([]string{"exec", router, iptables, "-C"}, rule...)...).Run() == nil {
+				err := exec.Command("docker", append([]string{"exec", router, iptables, "-D"}, rule...)...).Run()
+				if err != nil {
+					return errors.Wrapf(err, "failed to delete drop rule on %s", router)
+				}
+			}
+		}
+		if err := startVRRP(router); err != nil {
+			return err
+		}
+	}
+	// the primary router preempts the gateway IPs
+	primary, err := waitActiveRouter(routers[:1], "", gateway, timeout)
+	if err != nil {
+		return err
+	}
+	logger.V(0).Infof("Router %s recovered gateway %s after %v", primary, gateway, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// haRouters returns the routers of a highly available WAN
+func haRouters(name string) ([]string, error) {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(routers) < 2 {
+		return nil, fmt.Errorf("multicluster %s does not have a highly available WAN", name)
+	}
+	return routers, nil
+}
+
+// failoverGateway returns the gateway IP of the first cluster network,
+// all the gateway IPs are owned by the same router
+func failoverGateway(name string) (net.IP, error) {
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("no networks found for multicluster %s", name)
+	}
+	sort.Strings(networks)
+	subnets, err := docker.GetNetworkSubnets(networks[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("network %s has no subnets", networks[0])
+	}
+	return network.GetLastIPSubnet(subnets[0])
+}
+
+// activeRouter returns the router that owns the gateway IP, or an empty string
+func activeRouter(routers []string, gateway net.IP) (string, error) {
+	for _, router := range routers {
+		ok, err := routerHasIP(router, gateway)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return router, nil
+		}
+	}
+	return "", nil
+}
+
+// waitActiveRouter waits until one of the routers, other than the excluded one,
+// owns the gateway IP
+func waitActiveRouter(routers []string, exclude string, gateway net.IP, timeout time.Duration) (string, error) {
+	candidates := []string{}
+	for _, router := range routers {
+		if router != exclude {
+			candidates = append(candidates, router)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		active, err := activeRouter(candidates, gateway)
+		if err != nil {
+			return "", err
+		}
+		if active != "" {
+			return active, nil
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("timed out waiting for a router to own the gateway IP %s", gateway)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
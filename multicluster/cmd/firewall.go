@@ -0,0 +1,449 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// firewallChain is the chain of the firewall rules in the WAN routers
+	firewallChain = "MULTICLUSTER-FIREWALL"
+	// firewallLabel records in the routers the firewall rules of the
+	// configuration, so the firewall can be rebuilt without it
+	firewallLabel = "io.x-k8s.kind-networking-plugins.firewall"
+)
+
+const (
+	nodeSubnetType    = "node"
+	podSubnetType     = "pod"
+	serviceSubnetType = "service"
+)
+
+// FirewallRule allows or denies the traffic from one cluster to another,
+// the rules are evaluated in order and the traffic not matched is allowed
+type FirewallRule struct {
+	// From and To are the source and destination clusters, empty means any cluster
+	From string `yaml:"from,omitempty"`
+	To   string `yaml:"to,omitempty"`
+	// FromSubnet and ToSubnet restrict the rule to the node, pod or
+	// service subnets of the clusters, empty means all the subnets
+	FromSubnet string `yaml:"fromSubnet,omitempty"`
+	ToSubnet   string `yaml:"toSubnet,omitempty"`
+	// Protocol is tcp, udp, sctp or icmp, empty means any protocol
+	Protocol string `yaml:"protocol,omitempty"`
+	// Ports are the destination ports, only valid for tcp, udp and sctp
+	Ports []int `yaml:"ports,omitempty"`
+	// Action is allow or deny
+	Action string `yaml:"action"`
+}
+
+// String returns a description of the rule used as comment of the iptables rules
+func (r FirewallRule) String() string {
+	s := fmt.Sprintf("%s %s to %s", r.Action, firewallEndpoint(r.From, r.FromSubnet), firewallEndpoint(r.To, r.ToSubnet))
+	if r.Protocol != "" {
+		s += " " + r.Protocol
+	}
+	if len(r.Ports) > 0 {
+		s += "/" + joinPorts(r.Ports)
+	}
+	return s
+}
+
+func firewallEndpoint(cluster, subnetType string) string {
+	if cluster == "" {
+		cluster = "any"
+	}
+	if subnetType != "" {
+		cluster += "(" + subnetType + ")"
+	}
+	return cluster
+}
+
+func joinPorts(ports []int) string {
+	s := []string{}
+	for _, p := range ports {
+		s = append(s, strconv.Itoa(p))
+	}
+	return strings.Join(s, ",")
+}
+
+// validate checks the rule against the clusters of the configuration
+func (r FirewallRule) validate(clusters map[string]ClusterConfig) error {
+	for _, c := range []string{r.From, r.To} {
+		if _, ok := clusters[c]; c != "" && !ok {
+			return fmt.Errorf("cluster %s not found", c)
+		}
+	}
+	for _, t := range []string{r.FromSubnet, r.ToSubnet} {
+		switch t {
+		case "", nodeSubnetType, podSubnetType, serviceSubnetType:
+		default:
+			return fmt.Errorf("unknown subnet type %s", t)
+		}
+	}
+	switch r.Protocol {
+	case "", "icmp":
+		if len(r.Ports) > 0 {
+			return fmt.Errorf("ports require the tcp, udp or sctp protocol")
+		}
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("unknown protocol %s", r.Protocol)
+	}
+	switch r.Action {
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("unknown action %s", r.Action)
+	}
+	return nil
+}
+
+// firewallCmd represents the wan firewall command
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "List the hit counters of the WAN firewall rules",
+	Long: `List the hit counters of the WAN firewall rules.
+
+The counters are the packets and bytes that matched each rule of the
+firewall section of the configuration, added up for all the routers. With
+the tunnel interconnect both edge gateways of a path apply the rules, so
+the counters are listed per edge gateway.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, err := cmd.Flags().GetString("name")
+		if err != nil {
+			return err
+		}
+		return printFirewallCounters(cmd.OutOrStdout(), name)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(firewallCmd)
+
+	firewallCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+}
+
+// firewallHosts returns the containers that enforce the firewall, the WAN
+// routers or, if the traffic is tunneled, the edge gateways of the clusters
+func firewallHosts(name string) ([]string, error) {
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return nil, err
+	}
+	if interconnect == routedInterconnect {
+		return wanemRouters(name)
+	}
+	return edgeGateways(name)
+}
+
+// firewallRulesLabel returns the value of the label that records the rules
+func firewallRulesLabel(rules []FirewallRule) (string, error) {
+	if len(rules) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encode the firewall rules")
+	}
+	return string(b), nil
+}
+
+// wanFirewallRules returns the firewall rules recorded in the routers of a running multicluster
+func wanFirewallRules(name string) ([]FirewallRule, error) {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := docker.GetContainerLabels(routers[0])
+	if err != nil {
+		return nil, err
+	}
+	rules := []FirewallRule{}
+	if labels[firewallLabel] == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(labels[firewallLabel]), &rules); err != nil {
+		return nil, errors.Wrapf(err, "invalid firewall rules in router %s", routers[0])
+	}
+	return rules, nil
+}
+
+// applyFirewall replaces the firewall rules in the WAN with the rules recorded
+// in the routers, the rules are in their own chain that accepts the established
+// connections, so only the traffic that starts the connection has to be allowed
+// by the rules. The rules of clusters that do not belong to the multicluster are
+// skipped, so they are rebuilt each time a cluster is added or removed.
+func applyFirewall(name string) error {
+	rules, err := wanFirewallRules(name)
+	if err != nil {
+		return err
+	}
+	hosts, err := firewallHosts(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	ipv4Rules, ipv6Rules := [][]string{}, [][]string{}
+	for i, r := range rules {
+		if (r.From != "" && !sliceContains(networks, r.From)) || (r.To != "" && !sliceContains(networks, r.To)) {
+			continue
+		}
+		v4, v6, err := r.iptablesRules(i + 1)
+		if err != nil {
+			return errors.Wrapf(err, "failed to configure firewall rule %d", i+1)
+		}
+		ipv4Rules = append(ipv4Rules, v4...)
+		ipv6Rules = append(ipv6Rules, v6...)
+	}
+
+	families := []struct {
+		iptables string
+		rules    [][]string
+	}{
+		{"iptables", ipv4Rules},
+		{"ip6tables", ipv6Rules},
+	}
+	for _, host := range hosts {
+		for _, family := range families {
+			iptables, rules := family.iptables, family.rules
+			// the chain may exist if the firewall was already applied
+			exec.Command("docker", "exec", host, iptables, "-N", firewallChain).Run()
+			cmds := [][]string{
+				{"-F", firewallChain},
+				{"-A", firewallChain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+			}
+			for _, rule := range rules {
+				cmds = append(cmds, append([]string{"-A", firewallChain}, rule...))
+			}
+			if exec.Command("docker", "exec", host, iptables, "-C", "FORWARD", "-j", firewallChain).Run() != nil {
+				cmds = append(cmds, []string{"-I", "FORWARD", "-j", firewallChain})
+			}
+			for _, c := range cmds {
+				args := append([]string{"exec", host, iptables}, c...)
+				if err := exec.Command("docker", args...).Run(); err != nil {
+					return errors.Wrapf(err, "failed to run %s %s on %s", iptables, strings.Join(c, " "), host)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// iptablesRules returns the iptables and ip6tables rules of the firewall rule,
+// one per combination of source and destination subnets of the same IP family
+func (r FirewallRule) iptablesRules(index int) ([][]string, [][]string, error) {
+	from, err := firewallSubnets(r.From, r.FromSubnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := firewallSubnets(r.To, r.ToSubnet)
+	if err != nil {
+		return nil, nil, err
+	}
+	target := "ACCEPT"
+	if r.Action == "deny" {
+		target = "DROP"
+	}
+
+	ipv4Rules, ipv6Rules := [][]string{}, [][]string{}
+	for _, ipv6 := range []bool{false, true} {
+		sources := filterSubnets(from, ipv6)
+		destinations := filterSubnets(to, ipv6)
+		if len(sources) == 0 || len(destinations) == 0 {
+			continue
+		}
+		for _, src := range sources {
+			for _, dst := range destinations {
+				rule := []string{}
+				if src != "" {
+					rule = append(rule, "-s", src)
+				}
+				if dst != "" {
+					rule = append(rule, "-d", dst)
+				}
+				if r.Protocol != "" {
+					protocol := r.Protocol
+					if ipv6 && protocol == "icmp" {
+						protocol = "ipv6-icmp"
+					}
+					rule = append(rule, "-p", protocol)
+				}
+				if len(r.Ports) > 0 {
+					rule = append(rule, "-m", "multiport", "--dports", joinPorts(r.Ports))
+				}
+				rule = append(rule, "-m", "comment", "--comment", fmt.Sprintf("rule %d: %s", index, r), "-j", target)
+				if ipv6 {
+					ipv6Rules = append(ipv6Rules, rule)
+				} else {
+					ipv4Rules = append(ipv4Rules, rule)
+				}
+			}
+		}
+	}
+	return ipv4Rules, ipv6Rules, nil
+}
+
+// firewallSubnets returns the subnets of the type of the cluster,
+// an empty subnet matches any address of both IP families
+func firewallSubnets(clusterName, subnetType string) ([]string, error) {
+	if clusterName == "" {
+		return []string{""}, nil
+	}
+	subnets := []string{}
+	if subnetType == "" || subnetType == nodeSubnetType {
+		nodeSubnets, err := docker.GetNetworkSubnets(clusterName)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, nodeSubnets...)
+	}
+	labels, err := docker.GetNetworkLabels(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if (subnetType == "" || subnetType == podSubnetType) && labels[podSubnetLabel] != "" {
+		subnets = append(subnets, strings.Split(labels[podSubnetLabel], ",")...)
+	}
+	if (subnetType == "" || subnetType == serviceSubnetType) && labels[serviceSubnetLabel] != "" {
+		subnets = append(subnets, strings.Split(labels[serviceSubnetLabel], ",")...)
+	}
+	return subnets, nil
+}
+
+// filterSubnets returns the subnets of the IP family, keeping the empty subnet
+func filterSubnets(subnets []string, ipv6 bool) []string {
+	filtered := []string{}
+	for _, s := range subnets {
+		if s == "" || network.IsIPv6CIDR(s) == ipv6 {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
+
+// firewallCounter is the number of packets and bytes that matched a rule in
+// a gateway, the gateway is empty if the counters of the routers are added up
+type firewallCounter struct {
+	rule    string
+	gateway string
+	packets uint64
+	bytes   uint64
+}
+
+// ruleCommentRe matches the comment of the firewall rules in the iptables output
+var ruleCommentRe = regexp.MustCompile(`/\* (rule \d+: .*) \*/`)
+
+// firewallCounters returns the counters of the firewall rules, in order, added
+// up for all the IP families and for all the routers, only one of them forwards
+// the traffic. The edge gateways are not added up, the traffic between two
+// clusters crosses both edge gateways and would be counted twice.
+func firewallCounters(name string) ([]firewallCounter, error) {
+	hosts, err := firewallHosts(name)
+	if err != nil {
+		return nil, err
+	}
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return nil, err
+	}
+	perGateway := interconnect != routedInterconnect
+	counters := []firewallCounter{}
+	index := map[string]int{}
+	for _, host := range hosts {
+		for _, iptables := range []string{"iptables", "ip6tables"} {
+			// output format:
+			// pkts bytes target prot opt in out source destination
+			//   12   720 ACCEPT tcp  --  *  *   172.88.0.0/16 172.89.0.0/16 multiport dports 443 /* rule 1: allow ... */
+			lines, err := exec.OutputLines(exec.Command("docker", "exec", host, iptables, "-L", firewallChain, "-v", "-n", "-x"))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to list the firewall rules on %s", host)
+			}
+			for _, l := range lines {
+				match := ruleCommentRe.FindStringSubmatch(l)
+				fields := strings.Fields(l)
+				if match == nil || len(fields) < 2 {
+					continue
+				}
+				packets, err := strconv.ParseUint(fields[0], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				bytes, err := strconv.ParseUint(fields[1], 10, 64)
+				if err != nil {
+					return nil, err
+				}
+				gateway := ""
+				if perGateway {
+					gateway = host
+				}
+				key := gateway + "/" + match[1]
+				i, ok := index[key]
+				if !ok {
+					i = len(counters)
+					index[key] = i
+					counters = append(counters, firewallCounter{rule: match[1], gateway: gateway})
+				}
+				counters[i].packets += packets
+				counters[i].bytes += bytes
+			}
+		}
+	}
+	return counters, nil
+}
+
+func printFirewallCounters(out io.Writer, name string) error {
+	counters, err := firewallCounters(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if len(counters) > 0 && counters[0].gateway != "" {
+		fmt.Fprintln(w, "RULE\tGATEWAY\tPACKETS\tBYTES")
+		for _, c := range counters {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", c.rule, c.gateway, c.packets, c.bytes)
+		}
+		return w.Flush()
+	}
+	fmt.Fprintln(w, "RULE\tPACKETS\tBYTES")
+	for _, c := range counters {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", c.rule, c.packets, c.bytes)
+	}
+	return w.Flush()
+}
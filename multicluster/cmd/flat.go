@@ -0,0 +1,305 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// modeLabel records the mode of the multicluster in the flat network
+	modeLabel = "io.x-k8s.kind-networking-plugins.mode"
+
+	// routedMode connects each cluster network to the WAN emulator
+	routedMode = "routed"
+	// flatMode attaches all the clusters to one shared network, the
+	// traffic between clusters is routed directly by the nodes
+	flatMode = "flat"
+)
+
+// FlatConfig defines the shared network of the flat mode
+type FlatConfig struct {
+	// Subnet is the subnet of the shared network, it can be a
+	// comma separated list of IPv4 and IPv6 subnets
+	Subnet string `yaml:"subnet"`
+}
+
+func flatNetworkName(name string) string {
+	return "flat-" + name
+}
+
+// validateMode validates the mode of the configuration, the flat mode has
+// no router between the clusters so the options of the WAN are not valid.
+// The clusters nodeSubnet default to the subnet of the shared network.
+func validateMode(cfg *Config) error {
+	switch cfg.Mode {
+	case "", routedMode:
+		if cfg.Flat.Subnet != "" {
+			return fmt.Errorf("flat subnet is only valid in %s mode", flatMode)
+		}
+		return nil
+	case flatMode:
+	default:
+		return fmt.Errorf("unknown mode %s", cfg.Mode)
+	}
+	if cfg.Flat.Subnet == "" {
+		return fmt.Errorf("flat mode requires the flat subnet")
+	}
+	if _, err := subnetsIPFamily(cfg.Flat.Subnet); err != nil {
+		return errors.Wrapf(err, "invalid flat subnet %s", cfg.Flat.Subnet)
+	}
+	switch {
+	case cfg.Interconnect != "" && cfg.Interconnect != routedInterconnect:
+		return fmt.Errorf("interconnect %s is not supported in flat mode", cfg.Interconnect)
+	case cfg.Wan.HA || cfg.Wan.RenameInterfaces:
+		return fmt.Errorf("wan options are not supported in flat mode")
+	case len(cfg.Links) > 0:
+		return fmt.Errorf("links are not supported in flat mode")
+	case len(cfg.Firewall) > 0:
+		return fmt.Errorf("firewall rules are not supported in flat mode")
+	case cfg.Egress.Subnet != "":
+		return fmt.Errorf("egress is not supported in flat mode")
+	case len(cfg.Sites) > 0:
+		return fmt.Errorf("sites are not supported in flat mode")
+	case cfg.Proxy.Enabled:
+		return fmt.Errorf("proxy is not supported in flat mode")
+	case cfg.Topology.Type != "" && cfg.Topology.Type != fullMeshTopology:
+		return fmt.Errorf("topology %s is not supported in flat mode", cfg.Topology.Type)
+	}
+
+	// the pod and service subnets are routed between the clusters so they can not overlap
+	subnets := map[string]*net.IPNet{}
+	for clusterName, c := range cfg.Clusters {
+		if c.NodeSubnet != "" && c.NodeSubnet != cfg.Flat.Subnet {
+			return fmt.Errorf("cluster %s nodeSubnet %s does not match the flat subnet %s", clusterName, c.NodeSubnet, cfg.Flat.Subnet)
+		}
+		c.NodeSubnet = cfg.Flat.Subnet
+		cfg.Clusters[clusterName] = c
+		for _, s := range append(strings.Split(c.PodSubnet, ","), strings.Split(c.ServiceSubnet, ",")...) {
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return errors.Wrapf(err, "invalid subnet %s in cluster %s", s, clusterName)
+			}
+			for other, o := range subnets {
+				if cidr.Contains(o.IP) || o.Contains(cidr.IP) {
+					return fmt.Errorf("subnet %s of cluster %s overlaps with %s", s, clusterName, other)
+				}
+			}
+			subnets[clusterName+" "+s] = cidr
+		}
+	}
+	return nil
+}
+
+// multiClusterMode returns the mode of a running multicluster
+func multiClusterMode(name string) (string, error) {
+	networks, err := docker.ListNetworksByLabel(docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{modeLabel: flatMode},
+	))
+	if err != nil {
+		return "", err
+	}
+	if len(networks) > 0 {
+		return flatMode, nil
+	}
+	return routedMode, nil
+}
+
+// flatClusterLabels returns the labels of each cluster of a flat network,
+// the same labels a cluster network of the routed mode has. The network is
+// labeled with the subnets of every cluster suffixed by the cluster name.
+func flatClusterLabels(labels map[string]string) []map[string]string {
+	if labels[modeLabel] != flatMode {
+		return nil
+	}
+	clusters := []map[string]string{}
+	prefix := docker.ClusterLabel + "."
+	for k, clusterName := range labels {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		clusters = append(clusters, map[string]string{
+			docker.ClusterLabel: clusterName,
+			podSubnetLabel:      labels[podSubnetLabel+"."+clusterName],
+			serviceSubnetLabel:  labels[serviceSubnetLabel+"."+clusterName],
+		})
+	}
+	return clusters
+}
+
+// networkClusterLabels returns the labels of the clusters attached to
+// the network, one cluster network or all the clusters of a flat network
+func networkClusterLabels(labels map[string]string) []map[string]string {
+	if labels[modeLabel] == flatMode {
+		return flatClusterLabels(labels)
+	}
+	if _, ok := labels[docker.ClusterLabel]; ok {
+		return []map[string]string{labels}
+	}
+	return nil
+}
+
+// createFlatMultiCluster creates all the clusters in one shared network and
+// routes the pod and service subnets of each cluster through its nodes, the
+// images are loaded in the nodes
+func createFlatMultiCluster(name string, cfg *Config, clusterNames []string, images []string) error {
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{modeLabel: flatMode},
+	)
+	for _, clusterName := range clusterNames {
+		labels[docker.ClusterLabel+"."+clusterName] = clusterName
+		labels[podSubnetLabel+"."+clusterName] = cfg.Clusters[clusterName].PodSubnet
+		labels[serviceSubnetLabel+"."+clusterName] = cfg.Clusters[clusterName].ServiceSubnet
+	}
+	// there is no router, the docker host masquerades the traffic to internet,
+	// and the whole subnet is allocated so every cluster gets its own slice
+	flat := flatNetworkName(name)
+	if err := docker.CreateSharedNetwork(flat, cfg.Flat.Subnet, true, labels); err != nil {
+		return err
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	// the clusters are created one after the other, so the nodes of
+	// each cluster take a consecutive slice of the network addresses
+	os.Setenv("KIND_EXPERIMENTAL_DOCKER_NETWORK", flat)
+	defer os.Unsetenv("KIND_EXPERIMENTAL_DOCKER_NETWORK")
+	for _, clusterName := range clusterNames {
+		config, err := cfg.Clusters[clusterName].kindConfig(clusterName)
+		if err != nil {
+			return errors.Wrapf(err, "invalid configuration for cluster %s", clusterName)
+		}
+		if err := provider.Create(
+			clusterName,
+			cluster.CreateWithV1Alpha4Config(config),
+			cluster.CreateWithDisplayUsage(true),
+			cluster.CreateWithDisplaySalutation(true),
+		); err != nil {
+			return errors.Wrap(err, "failed to create cluster")
+		}
+	}
+	if err := loadClusterImages(provider, clusterNames, images); err != nil {
+		return err
+	}
+	return configureFlatRoutes(provider, clusterNames, cfg.Clusters)
+}
+
+// flatRoute is a route to a subnet of a cluster through one of its nodes
+type flatRoute struct {
+	subnet  string
+	gateway string
+}
+
+// configureFlatRoutes installs in every node the routes to the pod subnets of
+// the nodes of the other clusters, through each node, and to the service
+// subnets of the other clusters, through one of their nodes
+func configureFlatRoutes(provider *cluster.Provider, clusterNames []string, clusters map[string]ClusterConfig) error {
+	routes := map[string][]flatRoute{}
+	clusterNodes := map[string][]nodes.Node{}
+	for _, clusterName := range clusterNames {
+		internal, err := internalNodes(provider, clusterName)
+		if err != nil {
+			return err
+		}
+		clusterNodes[clusterName] = internal
+		routes[clusterName], err = flatClusterRoutes(provider, clusterName, clusters[clusterName], internal)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger := kindcmd.NewLogger()
+	for _, clusterName := range clusterNames {
+		for _, other := range clusterNames {
+			if other == clusterName {
+				continue
+			}
+			for _, n := range clusterNodes[clusterName] {
+				for _, r := range routes[other] {
+					if err := n.Command("ip", "route", "replace", r.subnet, "via", r.gateway).Run(); err != nil {
+						return errors.Wrapf(err, "failed to add route to %s via %s on %s", r.subnet, r.gateway, n.String())
+					}
+				}
+			}
+			logger.V(0).Infof("Routes to cluster %s installed in cluster %s", other, clusterName)
+		}
+	}
+	return nil
+}
+
+// flatClusterRoutes returns the routes to the subnets of the cluster, the pod
+// subnets of each node are obtained from the nodes spec and the services are
+// reached through the first node, using the node IP of the same family
+func flatClusterRoutes(provider *cluster.Provider, clusterName string, c ClusterConfig, internal []nodes.Node) ([]flatRoute, error) {
+	nodeIPs := map[string][2]string{}
+	for _, n := range internal {
+		ipv4, ipv6, err := n.IP()
+		if err != nil {
+			return nil, err
+		}
+		nodeIPs[n.String()] = [2]string{ipv4, ipv6}
+	}
+	gateway := func(nodeName, subnet string) string {
+		if network.IsIPv6CIDR(subnet) {
+			return nodeIPs[nodeName][1]
+		}
+		return nodeIPs[nodeName][0]
+	}
+
+	routes := []flatRoute{}
+	for _, s := range strings.Split(c.ServiceSubnet, ",") {
+		routes = append(routes, flatRoute{subnet: s, gateway: gateway(internal[0].String(), s)})
+	}
+	node, err := controlPlaneNode(provider, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	// output format: kind-worker 10.244.1.0/24 fd00:10:244:1::/64
+	jsonpath := `{range .items[*]}{.metadata.name}{range .spec.podCIDRs[*]}{" "}{@}{end}{"\n"}{end}`
+	lines, err := exec.OutputLines(kubectl(node, "get", "nodes", "-o", "jsonpath="+jsonpath))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get the pod subnets of the nodes of cluster %s", clusterName)
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, s := range fields[1:] {
+			if gw := gateway(fields[0], s); gw != "" {
+				routes = append(routes, flatRoute{subnet: s, gateway: gw})
+			}
+		}
+	}
+	return routes, nil
+}
@@ -0,0 +1,411 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/ipfix"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+	"sigs.k8s.io/kind/pkg/log"
+)
+
+// flowsComment identifies the rules that enable conntrack in the routers
+const flowsComment = "multicluster-flows"
+
+// flowsCmd represents the wan flows command
+var flowsCmd = &cobra.Command{
+	Use:   "flows",
+	Short: "Export the flows that cross the WAN emulator between clusters",
+	Long: `Export the flows that cross the WAN emulator between clusters.
+
+The exporter subscribes to the conntrack events of the WAN routers and emits a
+record when a connection ends, with the source and destination clusters, the
+5-tuple of the original direction, the bytes and packets of both directions,
+and the duration. The clusters are obtained from the node, pod and service
+subnets, the addresses outside the multicluster have no cluster. The flows
+within the same network are not exported.
+
+The records are sent to an IPFIX collector over UDP with --collector, the
+clusters are the descriptions of the ingress and egress interfaces, and are
+written as JSON lines to a file with --file, or to the standard output if
+none of them is set. The exporter runs in the foreground until it is
+interrupted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runFlows(cmd)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(flowsCmd)
+
+	flowsCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	flowsCmd.Flags().String(
+		"collector",
+		"",
+		"address of the IPFIX collector, i.e. 127.0.0.1:4739",
+	)
+	flowsCmd.Flags().String(
+		"file",
+		"",
+		"file to append the JSON records, - for the standard output",
+	)
+}
+
+// FlowRecord is a flow between clusters exported as a JSON line
+type FlowRecord struct {
+	Router       string    `json:"router"`
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	Duration     float64   `json:"durationSeconds"`
+	SrcCluster   string    `json:"srcCluster,omitempty"`
+	DstCluster   string    `json:"dstCluster,omitempty"`
+	Protocol     string    `json:"protocol"`
+	SrcIP        string    `json:"srcIP"`
+	DstIP        string    `json:"dstIP"`
+	SrcPort      uint16    `json:"srcPort,omitempty"`
+	DstPort      uint16    `json:"dstPort,omitempty"`
+	Bytes        uint64    `json:"bytes"`
+	Packets      uint64    `json:"packets"`
+	ReplyBytes   uint64    `json:"replyBytes"`
+	ReplyPackets uint64    `json:"replyPackets"`
+}
+
+// flowNetwork is a network of the multicluster and the subnets routed to it
+type flowNetwork struct {
+	name string
+	// cluster is the cluster attached to the network, or the network
+	// name if there is no cluster, like the public network
+	cluster string
+	subnets []*net.IPNet
+}
+
+// flowNetworks returns the networks of the multicluster, with the node subnets
+// and the pod and service subnets of the clusters
+func flowNetworks(name string) ([]flowNetwork, error) {
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return nil, err
+	}
+	flowNetworks := []flowNetwork{}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return nil, err
+		}
+		subnets, err := docker.GetNetworkSubnets(n)
+		if err != nil {
+			return nil, err
+		}
+		for _, label := range []string{podSubnetLabel, serviceSubnetLabel} {
+			if labels[label] != "" {
+				subnets = append(subnets, strings.Split(labels[label], ",")...)
+			}
+		}
+		fn := flowNetwork{name: n, cluster: labels[docker.ClusterLabel]}
+		if fn.cluster == "" {
+			fn.cluster = n
+		}
+		for _, s := range subnets {
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, err
+			}
+			fn.subnets = append(fn.subnets, cidr)
+		}
+		flowNetworks = append(flowNetworks, fn)
+	}
+	return flowNetworks, nil
+}
+
+// flowNetworkIndex returns the index of the network the IP belongs to, or -1
+func flowNetworkIndex(networks []flowNetwork, ip net.IP) int {
+	for i, n := range networks {
+		for _, subnet := range n.subnets {
+			if subnet.Contains(ip) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// flowSink writes the records to the IPFIX collector and the JSON file
+type flowSink struct {
+	mu       sync.Mutex
+	w        io.Writer
+	exporter *ipfix.Exporter
+}
+
+func runFlows(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	collector, err := cmd.Flags().GetString("collector")
+	if err != nil {
+		return err
+	}
+	file, err := cmd.Flags().GetString("file")
+	if err != nil {
+		return err
+	}
+	logger := kindcmd.NewLogger()
+
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	networks, err := flowNetworks(name)
+	if err != nil {
+		return err
+	}
+
+	sink := &flowSink{}
+	if collector != "" {
+		sink.exporter, err = ipfix.NewExporter(collector)
+		if err != nil {
+			return errors.Wrapf(err, "failed to connect to IPFIX collector %s", collector)
+		}
+		defer sink.exporter.Close()
+	}
+	switch {
+	case file == "-" || (file == "" && collector == ""):
+		sink.w = cmd.OutOrStdout()
+	case file != "":
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sink.w = f
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, len(routers))
+	for i, router := range routers {
+		if err := enableFlowAccounting(router); err != nil {
+			return errors.Wrapf(err, "failed to enable conntrack accounting in router %s", router)
+		}
+		defer disableFlowAccounting(router)
+		events, interfaces, err := subscribeFlows(router, networks)
+		if err != nil {
+			return errors.Wrapf(err, "failed to subscribe to the conntrack events of router %s", router)
+		}
+		logger.V(0).Infof("Exporting flows of router %s", router)
+		wg.Add(1)
+		go func(domain uint32, router string) {
+			defer wg.Done()
+			errs <- exportFlows(ctx, logger, sink, events, router, domain, networks, interfaces)
+		}(uint32(i+1), router)
+		// the receive blocks, closing the socket returns the exporter
+		go func() {
+			<-ctx.Done()
+			events.Close()
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		cancel()
+	}
+	wg.Wait()
+	return err
+}
+
+// enableFlowAccounting enables the counters and timestamps of conntrack in the router,
+// and adds a rule matching the conntrack state so the connections are tracked
+func enableFlowAccounting(router string) error {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		rule := []string{"FORWARD", "-m", "conntrack", "--ctstate", "NEW", "-m", "comment", "--comment", flowsComment}
+		if err := exec.Command("docker", append([]string{"exec", router, iptables, "-C"}, rule...)...).Run(); err == nil {
+			continue
+		}
+		if err := exec.Command("docker", append([]string{"exec", router, iptables, "-I"}, rule...)...).Run(); err != nil {
+			return err
+		}
+	}
+	return exec.Command("docker", "exec", router, "sysctl", "-w",
+		"net.netfilter.nf_conntrack_acct=1", "net.netfilter.nf_conntrack_timestamp=1").Run()
+}
+
+// disableFlowAccounting removes the rules added to track the connections
+func disableFlowAccounting(router string) {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		rule := []string{"FORWARD", "-m", "conntrack", "--ctstate", "NEW", "-m", "comment", "--comment", flowsComment}
+		exec.Command("docker", append([]string{"exec", router, iptables, "-D"}, rule...)...).Run()
+	}
+}
+
+// subscribeFlows subscribes to the conntrack events of the router and returns the
+// interfaces of the router connected to the networks, indexed as the networks
+func subscribeFlows(router string, networks []flowNetwork) (*network.ConntrackEvents, []ipfix.Interface, error) {
+	interfaces := make([]ipfix.Interface, len(networks))
+	for i, n := range networks {
+		// the router may not be connected to all the networks
+		iface, err := routerInterface(router, n.name)
+		if err != nil {
+			continue
+		}
+		index, err := clusterClassID(router, n.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		interfaces[i] = ipfix.Interface{Index: uint32(index), Name: iface, Description: n.cluster}
+	}
+	var events *network.ConntrackEvents
+	err := docker.InContainerNetns(router, func() error {
+		var err error
+		events, err = network.SubscribeConntrackDestroy()
+		return err
+	})
+	return events, interfaces, err
+}
+
+// exportFlows exports the flows between different networks until the context is done
+func exportFlows(ctx context.Context, logger log.Logger, sink *flowSink, events *network.ConntrackEvents,
+	router string, domain uint32, networks []flowNetwork, interfaces []ipfix.Interface) error {
+	described := []ipfix.Interface{}
+	for _, i := range interfaces {
+		if i.Index != 0 {
+			described = append(described, i)
+		}
+	}
+	for {
+		flows, err := events.Receive()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, syscall.ENOBUFS) {
+			logger.Warnf("Router %s lost conntrack events, the socket buffer is full", router)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, f := range flows {
+			src, dst := flowNetworkIndex(networks, f.SrcIP), flowNetworkIndex(networks, f.DstIP)
+			if src == dst {
+				continue
+			}
+			record := FlowRecord{
+				Router:       router,
+				Start:        f.Start,
+				End:          f.Stop,
+				Protocol:     protocolName(f.Protocol),
+				SrcIP:        f.SrcIP.String(),
+				DstIP:        f.DstIP.String(),
+				SrcPort:      f.SrcPort,
+				DstPort:      f.DstPort,
+				Bytes:        f.Bytes,
+				Packets:      f.Packets,
+				ReplyBytes:   f.ReplyBytes,
+				ReplyPackets: f.ReplyPackets,
+			}
+			if !f.Start.IsZero() && !f.Stop.IsZero() {
+				record.Duration = f.Stop.Sub(f.Start).Seconds()
+			}
+			ipfixRecord := ipfix.Record{
+				SrcIP:          f.SrcIP,
+				DstIP:          f.DstIP,
+				SrcPort:        f.SrcPort,
+				DstPort:        f.DstPort,
+				Protocol:       f.Protocol,
+				Bytes:          f.Bytes,
+				Packets:        f.Packets,
+				ReverseBytes:   f.ReplyBytes,
+				ReversePackets: f.ReplyPackets,
+				Start:          f.Start,
+				End:            f.Stop,
+			}
+			if src >= 0 {
+				record.SrcCluster = networks[src].cluster
+				ipfixRecord.Ingress = interfaces[src].Index
+			}
+			if dst >= 0 {
+				record.DstCluster = networks[dst].cluster
+				ipfixRecord.Egress = interfaces[dst].Index
+			}
+			// the errors writing the records are transient, the next records are written
+			if err := sink.write(domain, record, ipfixRecord, described); err != nil {
+				logger.Warnf("Failed to export flow record: %v", err)
+			}
+		}
+	}
+}
+
+func (s *flowSink) write(domain uint32, record FlowRecord, ipfixRecord ipfix.Record, interfaces []ipfix.Interface) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.exporter != nil {
+		if err := s.exporter.Export(domain, []ipfix.Record{ipfixRecord}, interfaces); err != nil {
+			return err
+		}
+	}
+	if s.w != nil {
+		b, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := s.w.Write(append(b, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// protocolName returns the name of the IP protocol, or its number if unknown
+func protocolName(protocol uint8) string {
+	switch protocol {
+	case syscall.IPPROTO_ICMP:
+		return "icmp"
+	case syscall.IPPROTO_TCP:
+		return "tcp"
+	case syscall.IPPROTO_UDP:
+		return "udp"
+	case syscall.IPPROTO_ICMPV6:
+		return "icmpv6"
+	case syscall.IPPROTO_SCTP:
+		return "sctp"
+	}
+	return strconv.Itoa(int(protocol))
+}
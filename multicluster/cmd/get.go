@@ -16,20 +16,41 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"sort"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+	"github.com/aojea/kind-networking-plugins/pkg/topology"
 
 	"sigs.k8s.io/kind/pkg/cluster"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
 )
 
 // getCmd represents the get command
 var getCmd = &cobra.Command{
 	Use:   "get",
 	Short: "Get the clusters that belong to the multi cluster",
-	Long:  `Get the clusters that belong to the multi cluster`,
+	Long: `Get the clusters that belong to the multi cluster.
+
+The output describes each member cluster: the nodes and its IPs, the node subnet
+and the gateway on the WAN emulator, the pod and service subnets, the WAN emulator
+interface facing the cluster and the impairments active on that interface.
+The sites attached to the WAN are described the same way.
+
+The dot and mermaid outputs render the topology as a Graphviz or Mermaid diagram:
+the docker networks and its subnets, the WAN routers and edge gateways with their
+interfaces, the clusters with their nodes, and the impairments of the links.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return getMultiCluster(cmd)
 	},
@@ -43,6 +64,59 @@ func init() {
 		cluster.DefaultName,
 		"the multicluster context name",
 	)
+	getCmd.Flags().StringP(
+		"output",
+		"o",
+		"table",
+		"output format: table, json, yaml, dot or mermaid",
+	)
+}
+
+// MultiClusterInfo describes a running multicluster
+type MultiClusterInfo struct {
+	Name     string        `json:"name" yaml:"name"`
+	Mode     string        `json:"mode" yaml:"mode"`
+	Wan      string        `json:"wan,omitempty" yaml:"wan,omitempty"`
+	Clusters []ClusterInfo `json:"clusters" yaml:"clusters"`
+	Sites    []SiteInfo    `json:"sites,omitempty" yaml:"sites,omitempty"`
+}
+
+// ClusterInfo describes a member cluster of the multicluster
+type ClusterInfo struct {
+	Name       string     `json:"name" yaml:"name"`
+	Nodes      []NodeInfo `json:"nodes" yaml:"nodes"`
+	NodeSubnet string     `json:"nodeSubnet" yaml:"nodeSubnet"`
+	// NodeRange is the slice of the shared subnet taken by the nodes in flat mode
+	NodeRange     string `json:"nodeRange,omitempty" yaml:"nodeRange,omitempty"`
+	Gateway       string `json:"gateway" yaml:"gateway"`
+	PodSubnet     string `json:"podSubnet" yaml:"podSubnet"`
+	ServiceSubnet string `json:"serviceSubnet" yaml:"serviceSubnet"`
+	EgressIP      string `json:"egressIP,omitempty" yaml:"egressIP,omitempty"`
+	// TopologyRole is hub or spoke in a hub-and-spoke topology
+	TopologyRole string   `json:"topologyRole,omitempty" yaml:"topologyRole,omitempty"`
+	WanInterface string   `json:"wanInterface" yaml:"wanInterface"`
+	Impairments  []string `json:"impairments,omitempty" yaml:"impairments,omitempty"`
+	// RouterInterfaces are the interfaces of the WAN routers connected to the cluster
+	RouterInterfaces []RouterInterfaceInfo `json:"routerInterfaces,omitempty" yaml:"routerInterfaces,omitempty"`
+}
+
+// SiteInfo describes an external host attached to the WAN
+type SiteInfo struct {
+	Name         string   `json:"name" yaml:"name"`
+	Image        string   `json:"image" yaml:"image"`
+	Subnet       string   `json:"subnet" yaml:"subnet"`
+	Gateway      string   `json:"gateway" yaml:"gateway"`
+	Addresses    []string `json:"addresses" yaml:"addresses"`
+	WanInterface string   `json:"wanInterface" yaml:"wanInterface"`
+	Impairments  []string `json:"impairments,omitempty" yaml:"impairments,omitempty"`
+}
+
+// NodeInfo describes a node of a member cluster
+type NodeInfo struct {
+	Name string `json:"name" yaml:"name"`
+	Role string `json:"role" yaml:"role"`
+	IPv4 string `json:"ipv4,omitempty" yaml:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty" yaml:"ipv6,omitempty"`
 }
 
 func getMultiCluster(cmd *cobra.Command) error {
@@ -50,6 +124,10 @@ func getMultiCluster(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
 	logger := kindcmd.NewLogger()
 
 	provider := cluster.NewProvider(
@@ -64,14 +142,453 @@ func getMultiCluster(cmd *cobra.Command) error {
 		return nil
 	}
 
-	var inClusters []string
-	clusterNamePrefix := fmt.Sprintf("multi-%s-", name)
-	for _, cluster := range clusters {
-		if strings.Contains(cluster, clusterNamePrefix) {
-			inClusters = append(inClusters, cluster)
+	info, err := getMultiClusterInfo(provider, name, clusters)
+	if err != nil {
+		return err
+	}
+
+	out := cmd.OutOrStdout()
+	switch output {
+	case "json":
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, string(b))
+	case "yaml":
+		b, err := yaml.Marshal(info)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, string(b))
+	case "table":
+		printMultiClusterTable(out, info)
+	case "dot", "mermaid":
+		g, err := getMultiClusterGraph(name, info)
+		if err != nil {
+			return err
 		}
+		return topology.Write(out, g, output)
+	default:
+		return fmt.Errorf("unsupported output format %q", output)
 	}
-	fmt.Printf("Multicluster %s contain following clusters: %v\n", name, inClusters)
 	// TODO: accumulate errors
 	return nil
 }
+
+// getMultiClusterInfo obtains the multicluster topology from the
+// labels of the docker networks and the running containers
+func getMultiClusterInfo(provider *cluster.Provider, name string, clusters []string) (*MultiClusterInfo, error) {
+	wanem := "wan-" + name
+	info := &MultiClusterInfo{
+		Name:     name,
+		Mode:     routedMode,
+		Wan:      wanem,
+		Clusters: []ClusterInfo{},
+	}
+
+	// the clusters are found through the labels of their networks,
+	// or the labels of the shared network in flat mode
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return nil, err
+	}
+	// the routers may not exist if the WAN emulator is gone
+	routers, err := wanemRouters(name)
+	if err != nil {
+		routers = []string{}
+	}
+	for _, n := range networks {
+		networkLabels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return nil, err
+		}
+		if siteName, ok := networkLabels[siteLabel]; ok {
+			site, err := getSiteInfo(n, siteName, wanem)
+			if err != nil {
+				return nil, err
+			}
+			info.Sites = append(info.Sites, *site)
+			continue
+		}
+		flat := networkLabels[modeLabel] == flatMode
+		if flat {
+			info.Mode = flatMode
+			info.Wan = ""
+		}
+		for _, labels := range networkClusterLabels(networkLabels) {
+			clusterName := labels[docker.ClusterLabel]
+			if !sliceContains(clusters, clusterName) {
+				continue
+			}
+			c, err := getClusterInfo(provider, n, flat, labels, wanem, routers)
+			if err != nil {
+				return nil, err
+			}
+			info.Clusters = append(info.Clusters, *c)
+		}
+	}
+	sort.Slice(info.Clusters, func(i, j int) bool { return info.Clusters[i].Name < info.Clusters[j].Name })
+	sort.Slice(info.Sites, func(i, j int) bool { return info.Sites[i].Name < info.Sites[j].Name })
+	return info, nil
+}
+
+// getSiteInfo describes the site attached to the network
+func getSiteInfo(n, siteName, wanem string) (*SiteInfo, error) {
+	site := &SiteInfo{Name: siteName, Addresses: []string{}}
+	subnets, err := docker.GetNetworkSubnets(n)
+	if err != nil {
+		return nil, err
+	}
+	gateways, err := routerAddresses(strings.Join(subnets, ","), 0, false)
+	if err != nil {
+		return nil, err
+	}
+	site.Subnet = strings.Join(subnets, ",")
+	site.Gateway = strings.Join(gateways, ",")
+	// the container may not exist if it was removed
+	lines, err := exec.OutputLines(exec.Command("docker", "inspect", "--format", "{{ .Config.Image }}", siteName))
+	if err == nil && len(lines) == 1 {
+		site.Image = lines[0]
+		site.Addresses, err = docker.GetContainerIPs(siteName, n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the interface may not exist if the WAN emulator is gone
+	iface, err := routerInterface(wanem, n)
+	if err == nil {
+		site.WanInterface = iface
+		site.Impairments, err = wanemImpairments(wanem, iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return site, nil
+}
+
+// getClusterInfo describes the cluster with the labels and attached to the
+// network, in flat mode the gateway is the docker gateway of the network
+func getClusterInfo(provider *cluster.Provider, n string, flat bool, labels map[string]string, wanem string, routers []string) (*ClusterInfo, error) {
+	clusterName := labels[docker.ClusterLabel]
+	c := ClusterInfo{
+		Name:          clusterName,
+		Nodes:         []NodeInfo{},
+		PodSubnet:     labels[podSubnetLabel],
+		ServiceSubnet: labels[serviceSubnetLabel],
+		EgressIP:      labels[egressIPLabel],
+		TopologyRole:  labels[topologyRoleLabel],
+	}
+	subnets, err := docker.GetNetworkSubnets(n)
+	if err != nil {
+		return nil, err
+	}
+	gateways := []string{}
+	for _, s := range subnets {
+		_, cidr, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		gateways = append(gateways, network.AddIPOffset(cidr.IP, 1).String())
+	}
+	if !flat {
+		gateways, err = routerAddresses(strings.Join(subnets, ","), 0, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	c.NodeSubnet = strings.Join(subnets, ",")
+	c.Gateway = strings.Join(gateways, ",")
+	// the interface may not exist if the WAN emulator is gone
+	iface, err := routerInterface(wanem, n)
+	if err == nil {
+		c.WanInterface = iface
+		c.Impairments, err = wanemImpairments(wanem, iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, router := range routers {
+		routerInfo, err := routerInterfaceInfo(router, n)
+		if err == nil {
+			c.RouterInterfaces = append(c.RouterInterfaces, routerInfo)
+		}
+	}
+
+	nodes, err := provider.ListNodes(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	for _, node := range nodes {
+		role, err := node.Role()
+		if err != nil {
+			return nil, err
+		}
+		ipv4, ipv6, err := node.IP()
+		if err != nil {
+			return nil, err
+		}
+		c.Nodes = append(c.Nodes, NodeInfo{
+			Name: node.String(),
+			Role: role,
+			IPv4: ipv4,
+			IPv6: ipv6,
+		})
+	}
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].Name < c.Nodes[j].Name })
+	if flat {
+		c.NodeRange = nodeRange(c.Nodes)
+	}
+	return &c, nil
+}
+
+// nodeRange returns the first and the last IP of the nodes of each family,
+// the clusters of the flat mode are created one after the other so they
+// take consecutive addresses
+func nodeRange(nodes []NodeInfo) string {
+	ranges := []string{}
+	for _, family := range []func(NodeInfo) string{
+		func(n NodeInfo) string { return n.IPv4 },
+		func(n NodeInfo) string { return n.IPv6 },
+	} {
+		var first, last net.IP
+		for _, n := range nodes {
+			ip := net.ParseIP(family(n))
+			if ip == nil {
+				continue
+			}
+			if first == nil || bytes.Compare(ip, first) < 0 {
+				first = ip
+			}
+			if last == nil || bytes.Compare(ip, last) > 0 {
+				last = ip
+			}
+		}
+		if first != nil {
+			ranges = append(ranges, first.String()+"-"+last.String())
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+func printMultiClusterTable(out io.Writer, info *MultiClusterInfo) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tNODE-SUBNET\tGATEWAY\tPOD-SUBNET\tSERVICE-SUBNET\tEGRESS-IP\tWAN-INTERFACE\tIMPAIRMENTS")
+	for _, c := range info.Clusters {
+		impairments := strings.Join(c.Impairments, ",")
+		if impairments == "" {
+			impairments = "<none>"
+		}
+		egressIP := c.EgressIP
+		if egressIP == "" {
+			egressIP = "<none>"
+		}
+		// the clusters of the flat mode share the subnet, show their slice
+		nodeSubnet := c.NodeSubnet
+		if c.NodeRange != "" {
+			nodeSubnet = c.NodeRange
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			c.Name, nodeSubnet, c.Gateway, c.PodSubnet, c.ServiceSubnet, egressIP, c.WanInterface, impairments)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CLUSTER\tROUTER\tINTERFACE\tMAC\tHOST-INTERFACE")
+	for _, c := range info.Clusters {
+		for _, i := range c.RouterInterfaces {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Name, i.Router, i.Interface, i.MAC, i.HostInterface)
+		}
+	}
+	if len(info.Sites) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "SITE\tIMAGE\tSUBNET\tGATEWAY\tADDRESSES\tWAN-INTERFACE\tIMPAIRMENTS")
+		for _, s := range info.Sites {
+			impairments := strings.Join(s.Impairments, ",")
+			if impairments == "" {
+				impairments = "<none>"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				s.Name, s.Image, s.Subnet, s.Gateway, strings.Join(s.Addresses, ","), s.WanInterface, impairments)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "CLUSTER\tNODE\tROLE\tIPV4\tIPV6")
+	for _, c := range info.Clusters {
+		for _, n := range c.Nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", c.Name, n.Name, n.Role, n.IPv4, n.IPv6)
+		}
+	}
+	w.Flush()
+}
+
+// getMultiClusterGraph obtains the topology diagram of the multicluster,
+// the clusters and nodes are the ones described by the info
+func getMultiClusterGraph(name string, info *MultiClusterInfo) (*topology.Graph, error) {
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(networks)
+	g := &topology.Graph{Name: name}
+	g.Networks, err = topology.NewNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+
+	// the routers may not exist if the WAN emulator is gone
+	routers, err := wanemRouters(name)
+	if err != nil {
+		routers = []string{}
+	}
+	edges, err := edgeGateways(name)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(edges)
+	for _, r := range append(routers, edges...) {
+		interfaces, err := topology.ContainerInterfaces(r, networks)
+		if err != nil {
+			return nil, err
+		}
+		for i := range interfaces {
+			interfaces[i].Name, err = routerInterface(r, interfaces[i].Network)
+			if err != nil {
+				return nil, err
+			}
+		}
+		g.Routers = append(g.Routers, topology.Router{Name: r, Interfaces: interfaces})
+	}
+	// all the routers of the WAN emulator have the same impairments
+	if len(routers) > 0 {
+		if err := addImpairmentsGraph(g, routers[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range info.Clusters {
+		cluster := topology.Cluster{Name: c.Name}
+		for _, n := range c.Nodes {
+			interfaces, err := topology.ContainerInterfaces(n.Name, networks)
+			if err != nil {
+				return nil, err
+			}
+			cluster.Nodes = append(cluster.Nodes, topology.Node{
+				Name:       n.Name,
+				Role:       n.Role,
+				Interfaces: interfaces,
+			})
+		}
+		g.Clusters = append(g.Clusters, cluster)
+	}
+	for _, s := range info.Sites {
+		// the site container may not exist
+		if s.Image == "" {
+			continue
+		}
+		interfaces, err := topology.ContainerInterfaces(s.Name, networks)
+		if err != nil {
+			return nil, err
+		}
+		g.Hosts = append(g.Hosts, topology.Host{Name: s.Name, Interfaces: interfaces})
+	}
+	return g, nil
+}
+
+// addImpairmentsGraph adds the impairments of the WAN emulator to the graph,
+// the impairments of the links become links between the networks and the
+// impairments of all the traffic on an interface are added to the interface
+func addImpairmentsGraph(g *topology.Graph, wanem string) error {
+	var router *topology.Router
+	for i := range g.Routers {
+		if g.Routers[i].Name == wanem {
+			router = &g.Routers[i]
+		}
+	}
+	if router == nil {
+		return nil
+	}
+	// the htb class of a link is the interface index of the source network
+	classes := map[string]string{}
+	for _, iface := range router.Interfaces {
+		classID, err := clusterClassID(wanem, iface.Network)
+		if err != nil {
+			return err
+		}
+		classes[fmt.Sprintf("1:%x", classID)] = iface.Network
+	}
+	for i, iface := range router.Interfaces {
+		qdiscs, err := wanemQdiscs(wanem, iface.Name)
+		if err != nil {
+			return err
+		}
+		for _, q := range qdiscs {
+			from, ok := classes[q.parent]
+			if !ok {
+				router.Interfaces[i].Impairments = append(router.Interfaces[i].Impairments, q.parameters)
+				continue
+			}
+			g.Links = append(g.Links, topology.Link{From: from, To: iface.Network, Label: q.parameters})
+		}
+	}
+	return nil
+}
+
+// wanemImpairments returns the impairments configured on the WAN emulator interface
+func wanemImpairments(wanem, iface string) ([]string, error) {
+	qdiscs, err := wanemQdiscs(wanem, iface)
+	if err != nil {
+		return nil, err
+	}
+	impairments := []string{}
+	for _, q := range qdiscs {
+		impairments = append(impairments, q.parameters)
+	}
+	return impairments, nil
+}
+
+// qdisc is an impairment qdisc and the parent class it is attached to
+type qdisc struct {
+	parent     string
+	parameters string
+}
+
+// wanemQdiscs returns the netem and tbf qdiscs configured on the WAN emulator interface
+func wanemQdiscs(wanem, iface string) ([]qdisc, error) {
+	// output format: qdisc netem 8001: root refcnt 2 limit 1000 delay 100ms
+	// or: qdisc netem 9: parent 1:9 limit 1000 delay 100ms
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", wanem, "tc", "qdisc", "show", "dev", iface))
+	if err != nil {
+		return nil, err
+	}
+	qdiscs := []qdisc{}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 3 || (fields[1] != "netem" && fields[1] != "tbf") {
+			continue
+		}
+		// skip the qdisc kind, handle, parent and queue limit
+		// and keep the parameters
+		q := qdisc{}
+		fields = fields[3:]
+		for len(fields) > 0 {
+			switch fields[0] {
+			case "root":
+				fields = fields[1:]
+				continue
+			case "refcnt", "parent", "limit":
+				if len(fields) >= 2 {
+					if fields[0] == "parent" {
+						q.parent = fields[1]
+					}
+					fields = fields[2:]
+					continue
+				}
+			}
+			break
+		}
+		if len(fields) > 0 {
+			q.parameters = strings.Join(fields, " ")
+			qdiscs = append(qdiscs, q)
+		}
+	}
+	return qdiscs, nil
+}
@@ -0,0 +1,70 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+)
+
+// requiredImages returns the images of the nodes and the containers of the
+// multicluster, they have to be available in the host to create it offline
+func requiredImages(cfg *Config, clusterNames []string, airgap bool, registryImage string) ([]string, error) {
+	images := []string{}
+	for _, clusterName := range clusterNames {
+		config, err := cfg.Clusters[clusterName].kindConfig(clusterName)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid configuration for cluster %s", clusterName)
+		}
+		images = append(images, docker.NodeImages(config)...)
+	}
+	// there are no routers in flat mode
+	if cfg.Mode != flatMode {
+		images = append(images, cfg.Wan.image())
+	}
+	if cfg.Proxy.Enabled {
+		images = append(images, dockerProxyImage)
+	}
+	for _, site := range cfg.Sites {
+		images = append(images, site.Image)
+	}
+	if airgap {
+		images = append(images, registryImage)
+	}
+	return images, nil
+}
+
+// loadClusterImages loads the images in the nodes of the clusters
+func loadClusterImages(provider *cluster.Provider, clusterNames []string, images []string) error {
+	if len(images) == 0 {
+		return nil
+	}
+	for _, clusterName := range clusterNames {
+		nodes, err := internalNodes(provider, clusterName)
+		if err != nil {
+			return err
+		}
+		if err := docker.LoadNodeImages(nodes, images); err != nil {
+			return errors.Wrapf(err, "failed to load images in cluster %s", clusterName)
+		}
+		kindcmd.NewLogger().V(0).Infof("Loaded %d images in cluster %s", len(images), clusterName)
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// htbRate is the rate of the htb classes, the traffic is shaped by netem
+	// so it just has to be higher than the traffic the WAN emulator can forward
+	htbRate = "10gbit"
+	// impairmentChain marks the traffic of the source clusters in the mangle table,
+	// before the egress SNAT rewrites the source address, so the classes of the
+	// impairments match the mark and not the source address
+	impairmentChain = "MULTICLUSTER-IMPAIRMENTS"
+)
+
+// LinkConfig defines the impairments of the traffic from one cluster to another
+type LinkConfig struct {
+	From       string `yaml:"from"`
+	To         string `yaml:"to"`
+	Impairment `yaml:",inline"`
+}
+
+// Impairment defines the network emulation parameters of a link
+type Impairment struct {
+	// Delay added to the packets, i.e. 100ms
+	Delay string `yaml:"delay,omitempty" json:"delay,omitempty"`
+	// Jitter of the delay, i.e. 10ms
+	Jitter string `yaml:"jitter,omitempty" json:"jitter,omitempty"`
+	// Loss is the percentage of packets dropped, i.e. 1%
+	Loss string `yaml:"loss,omitempty" json:"loss,omitempty"`
+	// Rate limits the bandwidth of the link, i.e. 10mbit
+	Rate string `yaml:"rate,omitempty" json:"rate,omitempty"`
+}
+
+// netemArgs returns the tc netem parameters of the impairment
+func (i Impairment) netemArgs() []string {
+	args := []string{}
+	if i.Delay != "" {
+		args = append(args, "delay", i.Delay)
+		if i.Jitter != "" {
+			args = append(args, i.Jitter)
+		}
+	}
+	if i.Loss != "" {
+		args = append(args, "loss", i.Loss)
+	}
+	if i.Rate != "" {
+		args = append(args, "rate", i.Rate)
+	}
+	return args
+}
+
+// applyLinks configures the impairments of the links in the WAN emulator
+func applyLinks(name string, links []LinkConfig) error {
+	for _, l := range links {
+		if err := setLinkImpairment(name, l.From, l.To, l.Impairment); err != nil {
+			return errors.Wrapf(err, "failed to configure link from %s to %s", l.From, l.To)
+		}
+	}
+	return nil
+}
+
+// restoreLinks restores the impairments of both directions of the path to
+// the ones defined in the config links, or removes them if not defined
+func restoreLinks(name, from, to string, links []LinkConfig) error {
+	for _, pair := range [][2]string{{from, to}, {to, from}} {
+		imp := Impairment{}
+		for _, l := range links {
+			if l.From == pair[0] && l.To == pair[1] {
+				imp = l.Impairment
+			}
+		}
+		if err := setLinkImpairment(name, pair[0], pair[1], imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLinkImpairment configures the impairment on the traffic from one cluster
+// to another. The traffic is classified on the interface of the WAN emulator
+// facing the destination cluster, each source cluster has its own htb class with
+// a netem qdisc, using the interface index of the source cluster as class id. The
+// traffic of the source subnets is marked with the class id before it is
+// translated, so the egress IPs do not bypass the impairments. An impairment
+// without parameters removes the existing one.
+func setLinkImpairment(name, from, to string, imp Impairment) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	// all the routers of the WAN emulator have the same impairments
+	for _, router := range routers {
+		if err := setRouterImpairment(router, from, to, imp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func setRouterImpairment(wanem, from, to string, imp Impairment) error {
+	toIface, err := routerInterface(wanem, to)
+	if err != nil {
+		return err
+	}
+	classID, err := clusterClassID(wanem, from)
+	if err != nil {
+		return err
+	}
+	netem := imp.netemArgs()
+	if len(netem) == 0 {
+		deleteClassImpairment(wanem, toIface, classID)
+		return nil
+	}
+	subnets, err := clusterSourceSubnets(from)
+	if err != nil {
+		return err
+	}
+
+	// the root qdisc sends the unclassified traffic to the default class
+	qdiscs, err := exec.OutputLines(exec.Command("docker", "exec", wanem, "tc", "qdisc", "show", "dev", toIface, "root"))
+	if err != nil {
+		return err
+	}
+	if len(qdiscs) == 0 || !strings.HasPrefix(qdiscs[0], "qdisc htb 1: root") {
+		err = tcWanem(wanem, "qdisc", "replace", "dev", toIface, "root", "handle", "1:", "htb", "default", "1")
+		if err != nil {
+			return err
+		}
+		err = tcWanem(wanem, "class", "replace", "dev", toIface, "parent", "1:", "classid", "1:1", "htb", "rate", htbRate)
+		if err != nil {
+			return err
+		}
+	}
+
+	class := fmt.Sprintf("1:%x", classID)
+	err = tcWanem(wanem, "class", "replace", "dev", toIface, "parent", "1:", "classid", class, "htb", "rate", htbRate)
+	if err != nil {
+		return err
+	}
+	args := []string{"qdisc", "replace", "dev", toIface, "parent", class, "handle", fmt.Sprintf("%x:", classID), "netem"}
+	err = tcWanem(wanem, append(args, netem...)...)
+	if err != nil {
+		return err
+	}
+	if err := markClassTraffic(wanem, toIface, classID, subnets); err != nil {
+		return err
+	}
+	// replace the filter of the class, it matches the mark of both IP families
+	deleteClassFilters(wanem, toIface, classID)
+	return tcWanem(wanem, "filter", "add", "dev", toIface, "parent", "1:", "protocol", "all",
+		"prio", strconv.Itoa(classID*2), "handle", strconv.Itoa(classID), "fw", "flowid", class)
+}
+
+// markClassTraffic replaces the rules that mark with the class id the traffic
+// of the source subnets that leaves the WAN emulator through the interface
+func markClassTraffic(wanem, iface string, classID int, subnets []string) error {
+	unmarkClassTraffic(wanem, iface, classID)
+	for _, subnet := range subnets {
+		iptables := iptablesCmd(subnet)
+		// the chain may exist if other impairments are configured
+		exec.Command("docker", "exec", wanem, iptables, "-t", "mangle", "-N", impairmentChain).Run()
+		cmds := [][]string{}
+		if exec.Command("docker", "exec", wanem, iptables, "-t", "mangle", "-C", "POSTROUTING", "-j", impairmentChain).Run() != nil {
+			cmds = append(cmds, []string{"-I", "POSTROUTING", "-j", impairmentChain})
+		}
+		cmds = append(cmds, []string{"-A", impairmentChain, "-o", iface, "-s", subnet,
+			"-m", "comment", "--comment", impairmentComment(iface, classID),
+			"-j", "MARK", "--set-mark", strconv.Itoa(classID)})
+		for _, c := range cmds {
+			args := append([]string{"exec", wanem, iptables, "-t", "mangle"}, c...)
+			if err := exec.Command("docker", args...).Run(); err != nil {
+				return errors.Wrapf(err, "failed to run %s %s on %s", iptables, strings.Join(c, " "), wanem)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarkClassTraffic deletes the rules that mark the traffic of the class,
+// the errors are ignored because the class may not be configured
+func unmarkClassTraffic(wanem, iface string, classID int) {
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		// output format: -A MULTICLUSTER-IMPAIRMENTS -s 10.0.0.0/16 -o eth1 -m comment --comment multicluster-impairment-eth1-7 -j MARK --set-xmark 0x7/0xffffffff
+		lines, err := exec.OutputLines(exec.Command("docker", "exec", wanem, iptables, "-t", "mangle", "-S", impairmentChain))
+		if err != nil {
+			continue
+		}
+		for _, l := range lines {
+			fields := strings.Fields(l)
+			if len(fields) < 2 || fields[0] != "-A" || !sliceContains(fields, impairmentComment(iface, classID)) {
+				continue
+			}
+			args := append([]string{"exec", wanem, iptables, "-t", "mangle", "-D"}, fields[1:]...)
+			exec.Command("docker", args...).Run()
+		}
+	}
+}
+
+func impairmentComment(iface string, classID int) string {
+	return fmt.Sprintf("multicluster-impairment-%s-%x", iface, classID)
+}
+
+// deleteClusterImpairments removes the impairments of the traffic
+// from the cluster on the interfaces facing the other clusters
+func deleteClusterImpairments(name, clusterName string, others []string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	for _, router := range routers {
+		classID, err := clusterClassID(router, clusterName)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			iface, err := routerInterface(router, other)
+			if err != nil {
+				return err
+			}
+			deleteClassImpairment(router, iface, classID)
+		}
+	}
+	return nil
+}
+
+// deleteClassImpairment removes the filters, marks, qdisc and class of the impairment
+// the errors are ignored because the class may not be configured
+func deleteClassImpairment(wanem, iface string, classID int) {
+	deleteClassFilters(wanem, iface, classID)
+	unmarkClassTraffic(wanem, iface, classID)
+	class := fmt.Sprintf("1:%x", classID)
+	tcWanem(wanem, "qdisc", "del", "dev", iface, "parent", class)
+	tcWanem(wanem, "class", "del", "dev", iface, "classid", class)
+}
+
+func deleteClassFilters(wanem, iface string, classID int) {
+	for _, prio := range []int{classID * 2, classID*2 + 1} {
+		tcWanem(wanem, "filter", "del", "dev", iface, "parent", "1:", "prio", strconv.Itoa(prio))
+	}
+}
+
+// clusterClassID returns the index of the interface of the WAN emulator
+// facing the cluster, that is unique and stable while the cluster exists
+func clusterClassID(wanem, clusterName string) (int, error) {
+	iface, err := routerInterface(wanem, clusterName)
+	if err != nil {
+		return 0, err
+	}
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", wanem, "cat", "/sys/class/net/"+iface+"/ifindex"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "error trying to get interface %s index", iface)
+	}
+	if len(lines) != 1 {
+		return 0, fmt.Errorf("interface %s index should only be one line, got %d lines", iface, len(lines))
+	}
+	return strconv.Atoi(lines[0])
+}
+
+// clusterSourceSubnets returns the node and pod subnets of the cluster
+func clusterSourceSubnets(clusterName string) ([]string, error) {
+	subnets, err := docker.GetNetworkSubnets(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	labels, err := docker.GetNetworkLabels(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if podSubnet := labels[podSubnetLabel]; podSubnet != "" {
+		subnets = append(subnets, strings.Split(podSubnet, ",")...)
+	}
+	return subnets, nil
+}
+
+func tcWanem(wanem string, args ...string) error {
+	args = append([]string{"exec", wanem, "tc"}, args...)
+	return exec.Command("docker", args...).Run()
+}
@@ -0,0 +1,523 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// interconnectLabel records the interconnect mode in the WAN emulator
+	interconnectLabel = "io.x-k8s.kind-networking-plugins.interconnect"
+	// edgeIndexLabel records the index of the edge gateway, it identifies
+	// the overlay tunnels between the edge gateways
+	edgeIndexLabel = "io.x-k8s.kind-networking-plugins.edge-index"
+	// wireguardKeyLabel records the public key of the edge gateway
+	wireguardKeyLabel = "io.x-k8s.kind-networking-plugins.wireguard-public-key"
+	edgeRole          = "edge"
+
+	// routedInterconnect routes the traffic between clusters in the WAN emulator
+	routedInterconnect = "routed"
+	// wireguardInterconnect, vxlanInterconnect and greInterconnect tunnel the
+	// traffic between clusters through the WAN emulator using tunnels between
+	// the edge gateways of the clusters
+	wireguardInterconnect = "wireguard"
+	vxlanInterconnect     = "vxlan"
+	greInterconnect       = "gre"
+
+	wireguardInterface = "wg0"
+	wireguardPort      = 51820
+	// wireguardMTU leaves room for the WireGuard overhead over IPv6
+	wireguardMTU = 1420
+
+	vxlanPort = 4789
+)
+
+// validateInterconnect validates the interconnect mode of the configuration
+func validateInterconnect(cfg *Config) error {
+	switch cfg.Interconnect {
+	case "", routedInterconnect:
+		return nil
+	case wireguardInterconnect, vxlanInterconnect, greInterconnect:
+	default:
+		return fmt.Errorf("unknown interconnect %s", cfg.Interconnect)
+	}
+	// the edge gateways own the gateway IPs of the cluster networks
+	if cfg.Wan.HA {
+		return fmt.Errorf("interconnect %s is not supported with a highly available WAN", cfg.Interconnect)
+	}
+	// the tunnels hide the clusters traffic from the WAN routers
+	if cfg.Topology.Type == hubAndSpokeTopology {
+		return fmt.Errorf("interconnect %s is not supported with a %s topology", cfg.Interconnect, hubAndSpokeTopology)
+	}
+	return nil
+}
+
+// wanInterconnect returns the interconnect mode of a running multicluster
+func wanInterconnect(name string) (string, error) {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return "", err
+	}
+	labels, err := docker.GetContainerLabels(routers[0])
+	if err != nil {
+		return "", err
+	}
+	if mode := labels[interconnectLabel]; mode != "" {
+		return mode, nil
+	}
+	return routedInterconnect, nil
+}
+
+func edgeName(clusterName string) string {
+	return "edge-" + clusterName
+}
+
+// edgeGateways returns the edge gateways of the multicluster
+func edgeGateways(name string) ([]string, error) {
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.RoleLabel: edgeRole},
+	)
+	edges, err := docker.ListContainersByLabel(labels)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(edges)
+	return edges, nil
+}
+
+// createEdgeGateway creates the gateway of the cluster network, it owns the
+// gateway IPs of the network and tunnels the traffic to the other clusters,
+// the WAN emulator forwards the tunnel traffic between the edge gateways.
+func createEdgeGateway(name, clusterName, interconnect string) error {
+	subnets, err := docker.GetNetworkSubnets(clusterName)
+	if err != nil {
+		return err
+	}
+	index, err := nextEdgeIndex(name)
+	if err != nil {
+		return err
+	}
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{
+			docker.RoleLabel:    edgeRole,
+			docker.ClusterLabel: clusterName,
+			edgeIndexLabel:      strconv.Itoa(index),
+		},
+	)
+	var private network.WireguardKey
+	if interconnect == wireguardInterconnect {
+		var public network.WireguardKey
+		private, public, err = network.GenerateWireguardKeys()
+		if err != nil {
+			return err
+		}
+		labels[wireguardKeyLabel] = public.String()
+	}
+
+	edge := edgeName(clusterName)
+	args := []string{"run",
+		"-d", // run in the background
+		"--sysctl=net.ipv4.ip_forward=1",
+		"--sysctl=net.ipv4.conf.all.rp_filter=0",
+		"--sysctl=net.ipv6.conf.all.disable_ipv6=0",
+		"--sysctl=net.ipv6.conf.all.forwarding=1",
+		"--privileged",
+		"--name", edge,
+		"--network", clusterName,
+	}
+	for _, subnet := range subnets {
+		gateway, err := network.GetLastIPSubnet(subnet)
+		if err != nil {
+			return err
+		}
+		if network.IsIPv6CIDR(subnet) {
+			args = append(args, "--ip6", gateway.String())
+		} else {
+			args = append(args, "--ip", gateway.String())
+		}
+	}
+	args = append(args, docker.LabelArgs(labels)...)
+	args = append(args, dockerWanImage)
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrapf(err, "failed to create edge gateway %s", edge)
+	}
+
+	// the tunnels go through the WAN emulator
+	wanIPs, err := routerAddresses(strings.Join(subnets, ","), 0, true)
+	if err != nil {
+		return err
+	}
+	for _, ip := range wanIPs {
+		if err := docker.ReplaceGateway(edge, ip); err != nil {
+			return err
+		}
+	}
+	// the overlay tunnels are created per peer
+	if interconnect != wireguardInterconnect {
+		return nil
+	}
+	return docker.InContainerNetns(edge, func() error {
+		if err := network.CreateWireguard(wireguardInterface, wireguardMTU); err != nil {
+			return errors.Wrap(err, "failed to create WireGuard interface, is the wireguard kernel module available?")
+		}
+		return network.ConfigureWireguard(wireguardInterface, network.WireguardConfig{
+			PrivateKey: &private,
+			ListenPort: wireguardPort,
+		})
+	})
+}
+
+// nextEdgeIndex returns the lowest index not used by the edge gateways
+func nextEdgeIndex(name string) (int, error) {
+	edges, err := edgeGateways(name)
+	if err != nil {
+		return 0, err
+	}
+	used := map[string]bool{}
+	for _, edge := range edges {
+		labels, err := docker.GetContainerLabels(edge)
+		if err != nil {
+			return 0, err
+		}
+		used[labels[edgeIndexLabel]] = true
+	}
+	index := 1
+	for used[strconv.Itoa(index)] {
+		index++
+	}
+	return index, nil
+}
+
+// edgeGateway is the tunnel configuration of an edge gateway
+type edgeGateway struct {
+	name  string
+	index int
+	// mac is the address of the edge gateway in the cluster network,
+	// used as the address of its VXLAN interfaces
+	mac       string
+	publicKey network.WireguardKey
+	// gateways are the addresses of the edge gateway, one per IP family
+	gateways []net.IP
+	// wanIPs are the addresses of the WAN emulator in the cluster network
+	wanIPs []string
+	// subnets are the node, pod and service subnets of the cluster
+	subnets []*net.IPNet
+}
+
+func getEdgeGateway(edge string) (*edgeGateway, error) {
+	labels, err := docker.GetContainerLabels(edge)
+	if err != nil {
+		return nil, err
+	}
+	index, err := strconv.Atoi(labels[edgeIndexLabel])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid index on %s", edge)
+	}
+	clusterName := labels[docker.ClusterLabel]
+	mac, err := docker.GetContainerMAC(edge, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	nodeSubnets, err := docker.GetNetworkSubnets(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	wanIPs, err := routerAddresses(strings.Join(nodeSubnets, ","), 0, true)
+	if err != nil {
+		return nil, err
+	}
+	gw := &edgeGateway{
+		name:   edge,
+		index:  index,
+		mac:    mac,
+		wanIPs: wanIPs,
+	}
+	if key := labels[wireguardKeyLabel]; key != "" {
+		gw.publicKey, err = network.ParseWireguardKey(key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid public key on %s", edge)
+		}
+	}
+	for _, subnet := range nodeSubnets {
+		gateway, err := network.GetLastIPSubnet(subnet)
+		if err != nil {
+			return nil, err
+		}
+		gw.gateways = append(gw.gateways, gateway)
+	}
+	subnets, err := clusterSourceSubnets(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	networkLabels, err := docker.GetNetworkLabels(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if svcSubnet := networkLabels[serviceSubnetLabel]; svcSubnet != "" {
+		subnets = append(subnets, strings.Split(svcSubnet, ",")...)
+	}
+	for _, s := range subnets {
+		_, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		gw.subnets = append(gw.subnets, subnet)
+	}
+	return gw, nil
+}
+
+// endpoint returns the address of the peer reachable from the edge gateway,
+// the local address and the address of the WAN emulator to reach it,
+// all of the same IP family
+func (gw *edgeGateway) endpoint(peer *edgeGateway) (net.IP, net.IP, string, error) {
+	for _, ip := range peer.gateways {
+		for i, wanIP := range gw.wanIPs {
+			if (net.ParseIP(wanIP).To4() == nil) == (ip.To4() == nil) {
+				return ip, gw.gateways[i], wanIP, nil
+			}
+		}
+	}
+	return nil, nil, "", fmt.Errorf("edge gateways %s and %s do not share an IP family", gw.name, peer.name)
+}
+
+// gateway returns the address of the edge gateway of the IP family of the subnet
+func (gw *edgeGateway) gateway(subnet *net.IPNet) (net.IP, bool) {
+	for _, ip := range gw.gateways {
+		if (ip.To4() == nil) == (subnet.IP.To4() == nil) {
+			return ip, true
+		}
+	}
+	return nil, false
+}
+
+// overlayInterface returns the name of the overlay tunnel to the edge gateway
+func overlayInterface(interconnect string, index int) string {
+	return fmt.Sprintf("%s-%d", interconnect, index)
+}
+
+// overlayVNI returns the VXLAN network identifier of the tunnel between two
+// edge gateways, it has to be the same in both ends and unique per edge gateway
+func overlayVNI(index1, index2 int) int {
+	if index1 > index2 {
+		index1, index2 = index2, index1
+	}
+	return index1<<12 | index2
+}
+
+// overlayMTU returns the MTU of the overlay tunnel leaving room for the
+// encapsulation overhead, the outer IPv6 header is 20 bytes bigger
+func overlayMTU(interconnect string, endpoint net.IP) int {
+	mtu := 1500 - 50 // VXLAN over IPv4
+	if interconnect == greInterconnect {
+		mtu = 1500 - 24 // GRE over IPv4
+	}
+	if endpoint.To4() == nil {
+		mtu -= 20
+	}
+	return mtu
+}
+
+// configureTunnels configures the tunnels between all the edge gateways of
+// the multicluster and routes the cluster subnets through them. WireGuard
+// uses one interface with a peer per cluster and the cluster subnets as
+// allowed IPs, the overlays use one point to point tunnel per cluster.
+func configureTunnels(name string) error {
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	edges, err := edgeGateways(name)
+	if err != nil {
+		return err
+	}
+	gws := []*edgeGateway{}
+	for _, edge := range edges {
+		gw, err := getEdgeGateway(edge)
+		if err != nil {
+			return err
+		}
+		gws = append(gws, gw)
+	}
+
+	for _, gw := range gws {
+		peers := []network.WireguardPeer{}
+		for _, peer := range gws {
+			if peer.name == gw.name {
+				continue
+			}
+			ip, local, wanIP, err := gw.endpoint(peer)
+			if err != nil {
+				return err
+			}
+			// the peer endpoint belongs to the peer node subnet,
+			// so it needs a more specific route through the WAN
+			if err := edgeRoute(gw.name, hostCIDR(ip), "via", wanIP); err != nil {
+				return err
+			}
+			switch interconnect {
+			case wireguardInterconnect:
+				peers = append(peers, network.WireguardPeer{
+					PublicKey:  peer.publicKey,
+					Endpoint:   &net.UDPAddr{IP: ip, Port: wireguardPort},
+					AllowedIPs: peer.subnets,
+				})
+				for _, subnet := range peer.subnets {
+					if err := edgeRoute(gw.name, subnet.String(), "dev", wireguardInterface); err != nil {
+						return err
+					}
+				}
+			case vxlanInterconnect, greInterconnect:
+				if err := configureOverlay(interconnect, gw, peer, local, ip); err != nil {
+					return err
+				}
+			}
+		}
+		if interconnect != wireguardInterconnect {
+			continue
+		}
+		err := docker.InContainerNetns(gw.name, func() error {
+			return network.ConfigureWireguard(wireguardInterface, network.WireguardConfig{
+				ReplacePeers: true,
+				Peers:        peers,
+			})
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to configure WireGuard peers on %s", gw.name)
+		}
+	}
+	return nil
+}
+
+// configureOverlay creates the overlay tunnel from the edge gateway to the
+// peer, if it does not exist, and routes the peer subnets through it.
+// VXLAN interfaces need a neighbor for the next hop, the peer gateway IPs
+// are used as next hops with the MAC of the peer tunnel interfaces.
+func configureOverlay(interconnect string, gw, peer *edgeGateway, local, remote net.IP) error {
+	iface := overlayInterface(interconnect, peer.index)
+	mac, err := net.ParseMAC(gw.mac)
+	if err != nil {
+		return err
+	}
+	err = docker.InContainerNetns(gw.name, func() error {
+		if network.InterfaceExists(iface) {
+			return nil
+		}
+		mtu := overlayMTU(interconnect, remote)
+		if interconnect == greInterconnect {
+			return network.CreateGre(iface, local, remote, mtu)
+		}
+		return network.CreateVxlan(iface, overlayVNI(gw.index, peer.index), local, remote, vxlanPort, mtu, mac)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s tunnel on %s", interconnect, gw.name)
+	}
+	for _, subnet := range peer.subnets {
+		if interconnect == greInterconnect {
+			if err := edgeRoute(gw.name, subnet.String(), "dev", iface); err != nil {
+				return err
+			}
+			continue
+		}
+		nexthop, ok := peer.gateway(subnet)
+		if !ok {
+			return fmt.Errorf("edge gateway %s has no address for subnet %s", peer.name, subnet)
+		}
+		err := exec.Command("docker", "exec", gw.name, "ip", "neigh", "replace", nexthop.String(),
+			"lladdr", peer.mac, "dev", iface, "nud", "permanent").Run()
+		if err != nil {
+			return errors.Wrapf(err, "failed to add neighbor %s on %s", nexthop, gw.name)
+		}
+		if err := edgeRoute(gw.name, subnet.String(), "via", nexthop.String(), "dev", iface, "onlink"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteEdgeGateway removes the edge gateway of the cluster and
+// the tunnels and routes of the other edge gateways to the cluster
+func deleteEdgeGateway(name, clusterName string) error {
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	gw, err := getEdgeGateway(edgeName(clusterName))
+	if err != nil {
+		return err
+	}
+	if err := docker.DeleteContainer(gw.name); err != nil {
+		return err
+	}
+	edges, err := edgeGateways(name)
+	if err != nil {
+		return err
+	}
+	for _, edge := range edges {
+		// the routes and tunnels may not exist, the errors are ignored
+		for _, ip := range gw.gateways {
+			exec.Command("docker", "exec", edge, "ip", "route", "del", hostCIDR(ip)).Run()
+		}
+		if interconnect != wireguardInterconnect {
+			// the routes through the tunnel are deleted with it
+			exec.Command("docker", "exec", edge, "ip", "link", "del", overlayInterface(interconnect, gw.index)).Run()
+			continue
+		}
+		for _, subnet := range gw.subnets {
+			exec.Command("docker", "exec", edge, "ip", "route", "del", subnet.String()).Run()
+		}
+	}
+	return configureTunnels(name)
+}
+
+// addRoutesEdge routes the subnets of the cluster through one of its nodes
+func addRoutesEdge(clusterName, gateway string, subnets ...string) error {
+	for _, subnet := range subnets {
+		if err := edgeRoute(edgeName(clusterName), subnet, "via", gateway); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func edgeRoute(edge, subnet string, nexthop ...string) error {
+	args := append([]string{"exec", edge, "ip", "route", "replace", subnet}, nexthop...)
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrapf(err, "failed to add route to %s on %s", subnet, edge)
+	}
+	return nil
+}
+
+// hostCIDR returns the host prefix of the IP address
+func hostCIDR(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/pkg/errors"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+// kubectl returns a command that runs kubectl in the node with the admin credentials
+func kubectl(node nodes.Node, args ...string) exec.Cmd {
+	args = append([]string{"--kubeconfig=/etc/kubernetes/admin.conf"}, args...)
+	return node.Command("kubectl", args...)
+}
+
+// controlPlaneNode returns the control plane node used to run kubectl in the cluster
+func controlPlaneNode(provider *cluster.Provider, clusterName string) (nodes.Node, error) {
+	allNodes, err := provider.ListNodes(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	node, err := nodeutils.BootstrapControlPlaneNode(allNodes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get control plane node of cluster %s", clusterName)
+	}
+	return node, nil
+}
+
+// internalNodes returns the Kubernetes nodes of the cluster, without
+// the external load balancer of the clusters with multiple control planes
+func internalNodes(provider *cluster.Provider, clusterName string) ([]nodes.Node, error) {
+	allNodes, err := provider.ListNodes(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	return nodeutils.InternalNodes(allNodes)
+}
@@ -0,0 +1,394 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+	"sigs.k8s.io/kind/pkg/log"
+)
+
+// loadBalancerCmd represents the loadbalancer command
+var loadBalancerCmd = &cobra.Command{
+	Use:   "loadbalancer",
+	Short: "Run a controller that assigns addresses to the LoadBalancer services",
+	Long: `Run a controller that assigns addresses to the LoadBalancer services.
+
+Each cluster has a pool of addresses in its node subnet, the 32 addresses after
+the range used by the containers. The WAN emulator, the edge gateways and the
+host route the pool to one of the cluster nodes, so the LoadBalancer addresses
+are reachable from the other clusters and from the host.
+
+The controller runs in the foreground until it is interrupted, the addresses
+assigned are kept in the services.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runLoadBalancer(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(loadBalancerCmd)
+
+	loadBalancerCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	loadBalancerCmd.Flags().StringSlice(
+		"cluster",
+		[]string{},
+		"the clusters to run the controller for, all the clusters if not set",
+	)
+	loadBalancerCmd.Flags().Duration(
+		"interval",
+		5*time.Second,
+		"time between the synchronizations of the services",
+	)
+}
+
+// loadBalancerPool returns the pool of LoadBalancer addresses of the node
+// subnet, the block after the ip range allocated to the containers
+func loadBalancerPool(subnet string) (*net.IPNet, error) {
+	_, cidr, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := cidr.Mask.Size()
+	// the pool and the ip range have the same size, see docker.CreateNetwork
+	if bits-ones < 6 {
+		return nil, fmt.Errorf("subnet %s is too small for a LoadBalancer pool", subnet)
+	}
+	return &net.IPNet{
+		IP:   network.AddIPOffset(cidr.IP, 1<<5),
+		Mask: net.CIDRMask(bits-5, bits),
+	}, nil
+}
+
+// loadBalancerCluster is a cluster managed by the controller
+type loadBalancerCluster struct {
+	name  string
+	pools []*net.IPNet
+}
+
+func runLoadBalancer(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	only, err := cmd.Flags().GetStringSlice("cluster")
+	if err != nil {
+		return err
+	}
+	interval, err := cmd.Flags().GetDuration("interval")
+	if err != nil {
+		return err
+	}
+	// the pools are routed by the WAN emulator, and in flat mode the
+	// nodes take any address of the shared subnet
+	mode, err := multiClusterMode(name)
+	if err != nil {
+		return err
+	}
+	if mode == flatMode {
+		return fmt.Errorf("the load balancer is not supported in %s mode", mode)
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	known := map[string]bool{}
+	clusters, err := loadBalancerClusters(provider, logger, name, only, known)
+	if err != nil {
+		return err
+	}
+	if len(clusters) == 0 {
+		return fmt.Errorf("no clusters found for multicluster %s", name)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	for first := true; ; first = false {
+		// the clusters added later and the routers recreated get
+		// their routes, the clusters removed are not synced anymore
+		if !first {
+			clusters, err = loadBalancerClusters(provider, logger, name, only, known)
+			if err != nil {
+				logger.Warnf("Failed to route the LoadBalancer pools: %v", err)
+			}
+		}
+		for _, c := range clusters {
+			// the errors are transient, the services are synced in the next interval
+			if err := syncLoadBalancers(provider, logger, c); err != nil {
+				logger.Warnf("Failed to sync LoadBalancer services of cluster %s: %v", c.name, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// loadBalancerClusters returns the clusters of the multicluster managed by the
+// controller and routes their pools, the routes are replaced each time so they
+// are restored if a router is recreated. The clusters whose pools can not be
+// routed are skipped, the pools of the clusters not known yet are logged.
+func loadBalancerClusters(provider *cluster.Provider, logger log.Logger, name string, only []string, known map[string]bool) ([]loadBalancerCluster, error) {
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return nil, err
+	}
+	clusters := []loadBalancerCluster{}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return nil, err
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if !ok || (len(only) > 0 && !sliceContains(only, clusterName)) {
+			continue
+		}
+		// the cluster may be being added, it is retried in the next interval
+		pools, err := routeLoadBalancerPools(provider, name, clusterName)
+		if err != nil {
+			logger.Warnf("Failed to route the LoadBalancer pool of cluster %s: %v", clusterName, err)
+			continue
+		}
+		if !known[clusterName] {
+			for _, pool := range pools {
+				logger.V(0).Infof("Cluster %s LoadBalancer pool %s", clusterName, pool)
+			}
+			known[clusterName] = true
+		}
+		clusters = append(clusters, loadBalancerCluster{name: clusterName, pools: pools})
+	}
+	return clusters, nil
+}
+
+// routeLoadBalancerPools routes the LoadBalancer pools of the cluster to one of
+// its nodes in the WAN routers, the edge gateway of the cluster and the host
+func routeLoadBalancerPools(provider *cluster.Provider, name, clusterName string) ([]*net.IPNet, error) {
+	subnets, err := docker.GetNetworkSubnets(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := internalNodes(provider, clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes found")
+	}
+	ipv4, ipv6, err := nodes[0].IP()
+	if err != nil {
+		return nil, err
+	}
+	gateways, err := wanemRouters(name)
+	if err != nil {
+		return nil, err
+	}
+	edges, err := edgeGateways(name)
+	if err != nil {
+		return nil, err
+	}
+	if sliceContains(edges, edgeName(clusterName)) {
+		gateways = append(gateways, edgeName(clusterName))
+	}
+
+	pools := []*net.IPNet{}
+	for _, subnet := range subnets {
+		pool, err := loadBalancerPool(subnet)
+		if err != nil {
+			return nil, err
+		}
+		nodeIP := ipv4
+		if network.IsIPv6CIDR(subnet) {
+			nodeIP = ipv6
+		}
+		for _, gateway := range gateways {
+			err := exec.Command("docker", "exec", gateway, "ip", "route", "replace", pool.String(), "via", nodeIP).Run()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to add route to %s on %s", pool, gateway)
+			}
+		}
+		// the host is connected to the cluster network
+		if err := network.ReplaceRoute(pool.String(), nodeIP); err != nil {
+			return nil, errors.Wrapf(err, "failed to add route to %s on the host", pool)
+		}
+		pools = append(pools, pool)
+	}
+	return pools, nil
+}
+
+// service has the fields of the Kubernetes services used by the controller
+type service struct {
+	Metadata struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		Type           string   `json:"type"`
+		ClusterIP      string   `json:"clusterIP"`
+		IPFamilies     []string `json:"ipFamilies"`
+		LoadBalancerIP string   `json:"loadBalancerIP"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP string `json:"ip"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+// syncLoadBalancers assigns addresses of the pools to the LoadBalancer services
+// of the cluster that do not have one, honoring the loadBalancerIP requested
+func syncLoadBalancers(provider *cluster.Provider, logger log.Logger, c loadBalancerCluster) error {
+	node, err := controlPlaneNode(provider, c.name)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Output(kubectl(node, "get", "services", "--all-namespaces", "-o", "json"))
+	if err != nil {
+		return err
+	}
+	list := struct {
+		Items []json.RawMessage `json:"items"`
+	}{}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return err
+	}
+
+	services := []service{}
+	used := map[string]bool{}
+	for _, item := range list.Items {
+		svc := service{}
+		if err := json.Unmarshal(item, &svc); err != nil {
+			return err
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			used[ingress.IP] = true
+		}
+		services = append(services, svc)
+	}
+
+	for i, svc := range services {
+		if svc.Spec.Type != "LoadBalancer" || len(svc.Status.LoadBalancer.Ingress) > 0 {
+			continue
+		}
+		ips := []string{}
+		for _, pool := range servicePools(svc, c.pools) {
+			ip, err := allocateLoadBalancerIP(pool, svc.Spec.LoadBalancerIP, used)
+			if err != nil {
+				return errors.Wrapf(err, "service %s/%s", svc.Metadata.Namespace, svc.Metadata.Name)
+			}
+			used[ip] = true
+			ips = append(ips, ip)
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		if err := updateLoadBalancerStatus(node, list.Items[i], ips); err != nil {
+			return errors.Wrapf(err, "failed to update service %s/%s", svc.Metadata.Namespace, svc.Metadata.Name)
+		}
+		logger.V(0).Infof("Cluster %s service %s/%s LoadBalancer %s", c.name, svc.Metadata.Namespace, svc.Metadata.Name, strings.Join(ips, ","))
+	}
+	return nil
+}
+
+// servicePools returns the pools of the IP families of the service
+func servicePools(svc service, pools []*net.IPNet) []*net.IPNet {
+	families := svc.Spec.IPFamilies
+	if len(families) == 0 {
+		// clusters without dual-stack support do not have the IP families
+		families = []string{"IPv4"}
+		if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil && ip.To4() == nil {
+			families = []string{"IPv6"}
+		}
+	}
+	result := []*net.IPNet{}
+	for _, family := range families {
+		for _, pool := range pools {
+			if (pool.IP.To4() == nil) == (family == "IPv6") {
+				result = append(result, pool)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// allocateLoadBalancerIP returns the address requested, if it belongs
+// to the pool, or the first free address of the pool
+func allocateLoadBalancerIP(pool *net.IPNet, requested string, used map[string]bool) (string, error) {
+	if ip := net.ParseIP(requested); ip != nil && pool.Contains(ip) {
+		if used[ip.String()] {
+			return "", fmt.Errorf("loadBalancerIP %s is already in use", requested)
+		}
+		return ip.String(), nil
+	}
+	ones, bits := pool.Mask.Size()
+	for i := 0; i < 1<<(bits-ones); i++ {
+		ip := network.AddIPOffset(pool.IP, i).String()
+		if !used[ip] {
+			return ip, nil
+		}
+	}
+	return "", fmt.Errorf("LoadBalancer pool %s is exhausted", pool)
+}
+
+// updateLoadBalancerStatus sets the LoadBalancer addresses in the service status
+func updateLoadBalancerStatus(node nodes.Node, item json.RawMessage, ips []string) error {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(item, &obj); err != nil {
+		return err
+	}
+	ingress := []map[string]string{}
+	for _, ip := range ips {
+		ingress = append(ingress, map[string]string{"ip": ip})
+	}
+	obj["status"] = map[string]interface{}{
+		"loadBalancer": map[string]interface{}{"ingress": ingress},
+	}
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	metadata, _ := obj["metadata"].(map[string]interface{})
+	path := fmt.Sprintf("/api/v1/namespaces/%s/services/%s/status", metadata["namespace"], metadata["name"])
+	return kubectl(node, "replace", "--raw", path, "-f", "-").SetStdin(strings.NewReader(string(body))).Run()
+}
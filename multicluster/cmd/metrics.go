@@ -0,0 +1,280 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+)
+
+// metricsPrefix is the prefix of the names of the WAN emulator metrics
+const metricsPrefix = "multicluster_wan_"
+
+// metricsCmd represents the wan metrics command
+var metricsCmd = &cobra.Command{
+	Use:   "metrics",
+	Short: "Expose the statistics of the WAN emulator as Prometheus metrics",
+	Long: `Expose the statistics of the WAN emulator as Prometheus metrics.
+
+The statistics of the router interfaces facing the networks of the multicluster
+and of their qdiscs are read via netlink from the network namespace of the routers:
+the bytes, packets and drops per direction of the interfaces, the bytes, packets,
+drops, overlimits and backlog of the qdiscs, and the delay, jitter and loss of the
+netem qdiscs. The metrics are labeled with the cluster the interface faces, and the
+qdiscs of the links with the cluster the traffic comes from.
+
+Without --listen the metrics are printed once, otherwise they are served on the
+/metrics path of the address until the command is interrupted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runMetrics(cmd)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(metricsCmd)
+
+	metricsCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	metricsCmd.Flags().String(
+		"listen",
+		"",
+		"address to serve the metrics, i.e. :9100",
+	)
+}
+
+func runMetrics(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	listen, err := cmd.Flags().GetString("listen")
+	if err != nil {
+		return err
+	}
+	if listen == "" {
+		return writeWanMetrics(cmd.OutOrStdout(), name)
+	}
+
+	logger := kindcmd.NewLogger()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		// the metrics are buffered so a failed scrape returns an error
+		var b bytes.Buffer
+		if err := writeWanMetrics(&b, name); err != nil {
+			logger.Warnf("Failed to get the WAN emulator metrics: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(b.Bytes())
+	})
+	logger.V(0).Infof("Serving WAN emulator metrics on %s/metrics", listen)
+	return http.ListenAndServe(listen, mux)
+}
+
+// metric is a metric family in the Prometheus text format
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples []string
+}
+
+// add adds a sample with the labels, that are pairs of names and values
+func (m *metric) add(value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		if labels[i+1] == "" {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	m.samples = append(m.samples, fmt.Sprintf("%s%s{%s} %v", metricsPrefix, m.name, strings.Join(pairs, ","), value))
+}
+
+func (m *metric) write(w io.Writer) error {
+	if len(m.samples) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "# HELP %[1]s%[2]s %[3]s\n# TYPE %[1]s%[2]s %[4]s\n%[5]s\n",
+		metricsPrefix, m.name, m.help, m.kind, strings.Join(m.samples, "\n"))
+	return err
+}
+
+// routerNetwork is a network of the multicluster the router is connected to
+type routerNetwork struct {
+	name    string
+	cluster string
+	mac     string
+}
+
+// writeWanMetrics writes the metrics of all the routers of the WAN emulator
+func writeWanMetrics(w io.Writer, name string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	sort.Strings(networks)
+
+	var (
+		ifBytes   = &metric{name: "interface_bytes_total", help: "Bytes received or transmitted by the router interface.", kind: "counter"}
+		ifPackets = &metric{name: "interface_packets_total", help: "Packets received or transmitted by the router interface.", kind: "counter"}
+		ifDrops   = &metric{name: "interface_drops_total", help: "Packets dropped by the router interface.", kind: "counter"}
+
+		qBytes      = &metric{name: "qdisc_bytes_total", help: "Bytes sent by the qdisc.", kind: "counter"}
+		qPackets    = &metric{name: "qdisc_packets_total", help: "Packets sent by the qdisc.", kind: "counter"}
+		qDrops      = &metric{name: "qdisc_drops_total", help: "Packets dropped by the qdisc.", kind: "counter"}
+		qOverlimits = &metric{name: "qdisc_overlimits_total", help: "Times the qdisc was over its limits.", kind: "counter"}
+		qRequeues   = &metric{name: "qdisc_requeues_total", help: "Packets requeued by the qdisc.", kind: "counter"}
+		qBacklog    = &metric{name: "qdisc_backlog_bytes", help: "Bytes queued in the qdisc.", kind: "gauge"}
+		qQlen       = &metric{name: "qdisc_backlog_packets", help: "Packets queued in the qdisc.", kind: "gauge"}
+
+		netemDelay  = &metric{name: "netem_delay_seconds", help: "Delay configured in the netem qdisc.", kind: "gauge"}
+		netemJitter = &metric{name: "netem_jitter_seconds", help: "Jitter of the delay configured in the netem qdisc.", kind: "gauge"}
+		netemLoss   = &metric{name: "netem_loss_ratio", help: "Ratio of packets dropped configured in the netem qdisc.", kind: "gauge"}
+		netemLimit  = &metric{name: "netem_limit_packets", help: "Queue limit configured in the netem qdisc.", kind: "gauge"}
+	)
+
+	for _, router := range routers {
+		routerNetworks := []routerNetwork{}
+		for _, n := range networks {
+			// the router may not be connected to all the networks
+			mac, err := docker.GetContainerMAC(router, n)
+			if err != nil {
+				continue
+			}
+			labels, err := docker.GetNetworkLabels(n)
+			if err != nil {
+				return err
+			}
+			routerNetworks = append(routerNetworks, routerNetwork{name: n, cluster: labels[docker.ClusterLabel], mac: mac})
+		}
+
+		var interfaces []network.InterfaceStats
+		var qdiscs []network.QdiscStats
+		err := docker.InContainerNetns(router, func() error {
+			var err error
+			interfaces, err = network.ListInterfaceStats()
+			if err != nil {
+				return err
+			}
+			qdiscs, err = network.ListQdiscStats()
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the statistics of router %s", router)
+		}
+
+		// the interfaces are matched with the networks by the MAC address
+		byIndex := map[int]network.InterfaceStats{}
+		networkByIndex := map[int]routerNetwork{}
+		for _, iface := range interfaces {
+			for _, n := range routerNetworks {
+				if iface.HardwareAddr.String() == n.mac {
+					byIndex[iface.Index] = iface
+					networkByIndex[iface.Index] = n
+				}
+			}
+		}
+		for index, iface := range byIndex {
+			n := networkByIndex[index]
+			labels := []string{"router", router, "interface", iface.Name, "network", n.name, "cluster", n.cluster}
+			ifBytes.add(float64(iface.RxBytes), append(labels, "direction", "receive")...)
+			ifBytes.add(float64(iface.TxBytes), append(labels, "direction", "transmit")...)
+			ifPackets.add(float64(iface.RxPackets), append(labels, "direction", "receive")...)
+			ifPackets.add(float64(iface.TxPackets), append(labels, "direction", "transmit")...)
+			ifDrops.add(float64(iface.RxDropped), append(labels, "direction", "receive")...)
+			ifDrops.add(float64(iface.TxDropped), append(labels, "direction", "transmit")...)
+		}
+
+		for _, q := range qdiscs {
+			iface, ok := byIndex[q.LinkIndex]
+			if !ok {
+				continue
+			}
+			n := networkByIndex[q.LinkIndex]
+			// the classes of the links are the interface index of the source network
+			from := ""
+			if q.Parent>>16 == 1 {
+				from = networkByIndex[int(q.Parent&0xffff)].cluster
+			}
+			labels := []string{
+				"router", router, "interface", iface.Name, "network", n.name, "cluster", n.cluster,
+				"kind", q.Kind, "handle", tcHandle(q.Handle), "parent", tcHandle(q.Parent), "from", from,
+			}
+			qBytes.add(float64(q.Bytes), labels...)
+			qPackets.add(float64(q.Packets), labels...)
+			qDrops.add(float64(q.Drops), labels...)
+			qOverlimits.add(float64(q.Overlimits), labels...)
+			qRequeues.add(float64(q.Requeues), labels...)
+			qBacklog.add(float64(q.Backlog), labels...)
+			qQlen.add(float64(q.Qlen), labels...)
+			if q.Netem != nil {
+				netemDelay.add(q.Netem.Delay.Seconds(), labels...)
+				netemJitter.add(q.Netem.Jitter.Seconds(), labels...)
+				netemLoss.add(q.Netem.Loss/100, labels...)
+				netemLimit.add(float64(q.Netem.Limit), labels...)
+			}
+		}
+	}
+
+	for _, m := range []*metric{
+		ifBytes, ifPackets, ifDrops,
+		qBytes, qPackets, qDrops, qOverlimits, qRequeues, qBacklog, qQlen,
+		netemDelay, netemJitter, netemLoss, netemLimit,
+	} {
+		sort.Strings(m.samples)
+		if err := m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tcHandle returns the handle in the major:minor format used by tc
+func tcHandle(handle uint32) string {
+	switch handle {
+	case 0xffffffff:
+		return "root"
+	case 0:
+		return "none"
+	}
+	if handle&0xffff == 0 {
+		return fmt.Sprintf("%x:", handle>>16)
+	}
+	return fmt.Sprintf("%x:%x", handle>>16, handle&0xffff)
+}
@@ -0,0 +1,402 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+	"github.com/aojea/kind-networking-plugins/pkg/proxy"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// proxyPortLabel records in the routers the port of the HTTP proxy, if enabled
+	proxyPortLabel   = "io.x-k8s.kind-networking-plugins.proxy-port"
+	defaultProxyPort = 3128
+	// dockerProxyImage runs the HTTP proxy next to each router, it is not
+	// published, make images builds it
+	dockerProxyImage = "kind-networking-plugins/proxy:v1"
+	proxyRole        = "proxy"
+	// blockEgressChain is the chain that drops the traffic of the clusters to
+	// internet, in the mangle table so it is evaluated before the firewall rules
+	blockEgressChain = "MULTICLUSTER-BLOCK-EGRESS"
+	// containerdProxyConf is the systemd drop-in with the proxy environment of containerd
+	containerdProxyConf = "/etc/systemd/system/containerd.service.d/http-proxy.conf"
+)
+
+// ProxyConfig defines the HTTP proxy of the clusters, the WAN routers drop
+// the traffic of the clusters to internet so it has to go through the proxy
+type ProxyConfig struct {
+	Enabled bool `yaml:"enabled,omitempty"`
+	// Port of the proxy in the WAN routers, 3128 by default
+	Port int `yaml:"port,omitempty"`
+}
+
+func (p ProxyConfig) port() int {
+	if p.Port == 0 {
+		return defaultProxyPort
+	}
+	return p.Port
+}
+
+func (p ProxyConfig) validate() error {
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid port %d", p.Port)
+	}
+	return nil
+}
+
+// proxyCmd represents the wan proxy command
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Run an HTTP proxy in the WAN routers in the foreground",
+	Long: `Run an HTTP proxy in the WAN routers in the foreground.
+
+The multicluster has to be created with the proxy enabled, the nodes use the
+proxy through the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables of containerd
+and of /etc/environment, and the WAN routers drop the traffic of the clusters
+to internet, so the components that ignore the proxy settings fail.
+
+The proxy of the clusters runs in a container in the network namespace of each
+router, started by create and removed by delete. This command is a debug mode:
+it listens in the network namespace of the routers, on a port different than
+the one of the clusters, connects to the destinations from there, forwarding the
+HTTP requests and tunneling the HTTPS connections, and logs every request until
+it is interrupted.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runProxy(cmd)
+	},
+}
+
+func init() {
+	wanCmd.AddCommand(proxyCmd)
+
+	proxyCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	proxyCmd.Flags().Int(
+		"port",
+		defaultProxyPort+1,
+		"the port of the proxy, the proxy of the clusters already listens on the configured one",
+	)
+}
+
+// wanProxyPort returns the port of the HTTP proxy of a running multicluster, 0 if disabled
+func wanProxyPort(name string) (int, error) {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return 0, err
+	}
+	labels, err := docker.GetContainerLabels(routers[0])
+	if err != nil {
+		return 0, err
+	}
+	if labels[proxyPortLabel] == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(labels[proxyPortLabel])
+}
+
+func runProxy(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	port, err := cmd.Flags().GetInt("port")
+	if err != nil {
+		return err
+	}
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	clusterPort, err := wanProxyPort(name)
+	if err != nil {
+		return err
+	}
+	if clusterPort == 0 {
+		return fmt.Errorf("the HTTP proxy is not enabled in multicluster %s", name)
+	}
+	if port == clusterPort {
+		return fmt.Errorf("the proxy of the clusters listens on port %d, use a different port", port)
+	}
+
+	logger := kindcmd.NewLogger()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	errs := make(chan error, len(routers))
+	for _, router := range routers {
+		ns, err := docker.GetContainerNetns(router)
+		if err != nil {
+			return errors.Wrapf(err, "failed to get the network namespace of router %s", router)
+		}
+		defer ns.Close()
+		// the listener keeps the namespace it was created in
+		var listener net.Listener
+		err = docker.InContainerNetns(router, func() error {
+			listener, err = net.Listen("tcp", ":"+strconv.Itoa(port))
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to listen on router %s", router)
+		}
+		router := router
+		server := &http.Server{
+			Handler: &proxy.Proxy{
+				Dial: func(ctx context.Context, proto, address string) (net.Conn, error) {
+					return network.DialInNetns(ctx, ns, proto, address)
+				},
+				Log: func(method, host string, err error) {
+					if err != nil {
+						logger.Warnf("%s %s %s: %v", router, method, host, err)
+						return
+					}
+					logger.V(0).Infof("%s %s %s", router, method, host)
+				},
+			},
+		}
+		go func() {
+			errs <- server.Serve(listener)
+		}()
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		logger.V(0).Infof("HTTP proxy listening on router %s port %d", router, port)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// configureProxy starts the HTTP proxy of the WAN routers, configures the nodes
+// of all the clusters to use it, and drops the traffic of the clusters to
+// internet in the routers. The traffic to the node, pod and service subnets of
+// the multicluster does not use the proxy.
+func configureProxy(provider *cluster.Provider, name string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	port, err := wanProxyPort(name)
+	if err != nil {
+		return err
+	}
+	for _, router := range routers {
+		if err := startProxy(name, router, port); err != nil {
+			return err
+		}
+	}
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+
+	noProxy := []string{"localhost", "127.0.0.1", "::1", ".svc", ".cluster.local"}
+	clusters := map[string]string{}
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return err
+		}
+		if _, ok := labels[siteLabel]; ok {
+			subnets, err := docker.GetNetworkSubnets(n)
+			if err != nil {
+				return err
+			}
+			noProxy = append(noProxy, subnets...)
+			continue
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if !ok {
+			continue
+		}
+		subnets, err := firewallSubnets(n, "")
+		if err != nil {
+			return err
+		}
+		noProxy = append(noProxy, subnets...)
+		clusters[clusterName] = n
+	}
+
+	for _, router := range routers {
+		if err := blockEgress(router, "direct egress blocked by the HTTP proxy"); err != nil {
+			return err
+		}
+	}
+
+	logger := kindcmd.NewLogger()
+	for clusterName, n := range clusters {
+		subnets, err := docker.GetNetworkSubnets(n)
+		if err != nil {
+			return err
+		}
+		// the proxy is reached through the gateway, or the address of
+		// the router in the network if the gateway is an edge gateway
+		addresses, err := routerAddresses(strings.Join(subnets, ","), 0, interconnect != routedInterconnect)
+		if err != nil {
+			return err
+		}
+		url := proxyURL(addresses, port)
+		nodes, err := internalNodes(provider, clusterName)
+		if err != nil {
+			return err
+		}
+		for _, node := range nodes {
+			if err := configureNodeProxy(node, url, strings.Join(noProxy, ",")); err != nil {
+				return errors.Wrapf(err, "failed to configure the proxy on node %s", node.String())
+			}
+		}
+		logger.V(0).Infof("Cluster %s uses the HTTP proxy %s", clusterName, url)
+	}
+	return nil
+}
+
+// startProxy runs the HTTP proxy in a container that shares the network namespace
+// of the router, so it reaches internet through the router, if it is not running
+func startProxy(name, router string, port int) error {
+	container := router + "-proxy"
+	if exec.Command("docker", "inspect", container).Run() == nil {
+		return nil
+	}
+	args := []string{"run",
+		"-d", // run in the background
+		"--name", container,
+		"--network", "container:" + router,
+		"--restart", "unless-stopped",
+	}
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.RoleLabel: proxyRole},
+	)
+	args = append(args, docker.LabelArgs(labels)...)
+	args = append(args, dockerProxyImage, "-port", strconv.Itoa(port))
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrapf(err, "failed to run the HTTP proxy of router %s", router)
+	}
+	kindcmd.NewLogger().V(0).Infof("HTTP proxy %s listening on router %s port %d", container, router, port)
+	return nil
+}
+
+// proxyURL returns the URL of the proxy, using the IPv4 address if there is one
+func proxyURL(addresses []string, port int) string {
+	address := addresses[0]
+	for _, a := range addresses {
+		if !strings.Contains(a, ":") {
+			address = a
+			break
+		}
+	}
+	return "http://" + net.JoinHostPort(address, strconv.Itoa(port))
+}
+
+// configureNodeProxy sets the proxy variables in the environment of containerd,
+// restarting it, and in /etc/environment, with the upper and lower case names
+func configureNodeProxy(node nodes.Node, url, noProxy string) error {
+	env := []string{}
+	for _, v := range [][2]string{{"HTTP_PROXY", url}, {"HTTPS_PROXY", url}, {"NO_PROXY", noProxy}} {
+		env = append(env, v[0]+"="+v[1], strings.ToLower(v[0])+"="+v[1])
+	}
+	var conf strings.Builder
+	conf.WriteString("[Service]\n")
+	for _, e := range env {
+		fmt.Fprintf(&conf, "Environment=%q\n", e)
+	}
+
+	if err := node.Command("mkdir", "-p", "/etc/systemd/system/containerd.service.d").Run(); err != nil {
+		return err
+	}
+	if err := node.Command("cp", "/dev/stdin", containerdProxyConf).SetStdin(strings.NewReader(conf.String())).Run(); err != nil {
+		return err
+	}
+	// replace the proxy variables of /etc/environment
+	script := `grep -vi '_proxy=' /etc/environment > /etc/environment.proxy; cat >> /etc/environment.proxy && mv /etc/environment.proxy /etc/environment`
+	if err := node.Command("sh", "-c", script).SetStdin(strings.NewReader(strings.Join(env, "\n") + "\n")).Run(); err != nil {
+		return err
+	}
+	if err := node.Command("systemctl", "daemon-reload").Run(); err != nil {
+		return err
+	}
+	return node.Command("systemctl", "restart", "containerd").Run()
+}
+
+// blockEgress drops the traffic forwarded by the router to internet, through the
+// interfaces of its default routes, the traffic of the router is not dropped
+func blockEgress(router, reason string) error {
+	devs := []string{}
+	for _, family := range []string{"-4", "-6"} {
+		// output format: default via 172.17.0.1 dev eth0
+		lines, err := exec.OutputLines(exec.Command("docker", "exec", router, "ip", family, "-o", "route", "show", "default"))
+		if err != nil {
+			return err
+		}
+		for _, l := range lines {
+			fields := strings.Fields(l)
+			for i, f := range fields {
+				if f == "dev" && i+1 < len(fields) && !sliceContains(devs, fields[i+1]) {
+					devs = append(devs, fields[i+1])
+				}
+			}
+		}
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		// the chain may exist if the egress was already blocked
+		exec.Command("docker", "exec", router, iptables, "-t", "mangle", "-N", blockEgressChain).Run()
+		cmds := [][]string{{"-F", blockEgressChain}}
+		for _, dev := range devs {
+			cmds = append(cmds, []string{"-A", blockEgressChain, "-o", dev,
+				"-m", "comment", "--comment", reason, "-j", "DROP"})
+		}
+		if exec.Command("docker", "exec", router, iptables, "-t", "mangle", "-C", "FORWARD", "-j", blockEgressChain).Run() != nil {
+			cmds = append(cmds, []string{"-I", "FORWARD", "-j", blockEgressChain})
+		}
+		for _, c := range cmds {
+			args := append([]string{"exec", router, iptables, "-t", "mangle"}, c...)
+			if err := exec.Command("docker", args...).Run(); err != nil {
+				return errors.Wrapf(err, "failed to run %s %s on %s", iptables, strings.Join(c, " "), router)
+			}
+		}
+	}
+	return nil
+}
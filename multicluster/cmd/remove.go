@@ -0,0 +1,192 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+// removeCmd represents the remove command
+var removeCmd = &cobra.Command{
+	Use:   "remove CLUSTER",
+	Short: "Remove a cluster from a running multicluster",
+	Long: `Remove a cluster from a running multicluster.
+
+The routes and impairments of the cluster are removed from the WAN emulator,
+and the cluster and its network are deleted, the other clusters are not modified.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return removeCluster(cmd, args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(removeCmd)
+
+	removeCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+}
+
+func removeCluster(cmd *cobra.Command, clusterName string) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+
+	// the clusters of a flat network are fixed when the network is created
+	mode, err := multiClusterMode(name)
+	if err != nil {
+		return err
+	}
+	if mode == flatMode {
+		return fmt.Errorf("clusters can not be removed from a multicluster in %s mode", mode)
+	}
+
+	// find the cluster network and the other clusters of the multicluster
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	var clusterLabels map[string]string
+	others := []string{}
+	for _, network := range networks {
+		labels, err := docker.GetNetworkLabels(network)
+		if err != nil {
+			return err
+		}
+		// the sites have impairments from the cluster too
+		if site, ok := labels[siteLabel]; ok {
+			others = append(others, site)
+			continue
+		}
+		c, ok := labels[docker.ClusterLabel]
+		if !ok {
+			continue
+		}
+		if c == clusterName {
+			clusterLabels = labels
+		} else {
+			others = append(others, c)
+		}
+	}
+	if clusterLabels == nil {
+		return fmt.Errorf("cluster %s does not belong to multicluster %s", clusterName, name)
+	}
+
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+
+	// remove the impairments of the traffic from the cluster, the ones
+	// to the cluster are removed with the interface of the WAN emulator
+	if err := deleteClusterImpairments(name, clusterName, others); err != nil {
+		return err
+	}
+	if err := deleteClusterEgress(name, clusterName); err != nil {
+		return err
+	}
+	interconnect, err := wanInterconnect(name)
+	if err != nil {
+		return err
+	}
+	if interconnect == routedInterconnect {
+		// remove the routes to the cluster services and pods
+		subnets := strings.Split(clusterLabels[serviceSubnetLabel], ",")
+		subnets = append(subnets, strings.Split(clusterLabels[podSubnetLabel], ",")...)
+		for _, subnet := range subnets {
+			if subnet == "" {
+				continue
+			}
+			for _, router := range routers {
+				if err := exec.Command("docker", "exec", router, "ip", "route", "del", subnet).Run(); err != nil {
+					return errors.Wrapf(err, "failed to delete route to %s on %s", subnet, router)
+				}
+			}
+		}
+	} else {
+		// remove the edge gateway of the cluster and the tunnels to the cluster
+		if err := deleteEdgeGateway(name, clusterName); err != nil {
+			return err
+		}
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	clusters, err := provider.List()
+	if err != nil {
+		return err
+	}
+	if sliceContains(clusters, clusterName) {
+		if err := provider.Delete(clusterName, ""); err != nil {
+			return errors.Wrapf(err, "failed to delete cluster %q", clusterName)
+		}
+		logger.V(0).Infof("Deleted clusters: %q", clusterName)
+	}
+	for _, router := range routers {
+		// docker removes the interface by the name it was given
+		if err := restoreRouterInterfaceName(router, clusterName); err != nil {
+			return err
+		}
+		if err := docker.DisconnectNetwork(router, clusterName); err != nil {
+			return errors.Wrapf(err, "failed to disconnect %s from network %s", router, clusterName)
+		}
+	}
+	registry, _, err := airgapRegistry(name)
+	if err != nil {
+		return err
+	}
+	if registry != "" {
+		if err := docker.DisconnectNetwork(registry, clusterName); err != nil {
+			return errors.Wrapf(err, "failed to disconnect %s from network %s", registry, clusterName)
+		}
+	}
+	if err := docker.DeleteNetwork(clusterName); err != nil {
+		return err
+	}
+	// remove the rules and routes of the cluster from the topology
+	if err := applyTopology(provider, name); err != nil {
+		return err
+	}
+	// rebuild the firewall without the rules of the cluster, so a
+	// cluster that reuses its subnets does not inherit them
+	if err := applyFirewall(name); err != nil {
+		return err
+	}
+	if err := configureAPIServers(provider, name); err != nil {
+		return err
+	}
+	// stop announcing the gateway IPs of the removed network
+	if len(routers) > 1 {
+		return configureVRRP(name)
+	}
+	return nil
+}
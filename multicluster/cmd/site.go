@@ -0,0 +1,124 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// siteLabel records the site of the network
+	siteLabel = "io.x-k8s.kind-networking-plugins.site"
+	siteRole  = "site"
+)
+
+// SiteConfig defines an external host attached to the WAN, in its own
+// network behind the routers like the clusters
+type SiteConfig struct {
+	Subnet string `yaml:"subnet"`
+	// Image and Command of the site container, the command
+	// of the image is used if the command is empty
+	Image   string   `yaml:"image"`
+	Command []string `yaml:"command,omitempty"`
+}
+
+// validateSites validates the sites of the configuration, the sites share
+// the names of the networks and the links with the clusters
+func validateSites(cfg *Config) error {
+	if len(cfg.Sites) == 0 {
+		return nil
+	}
+	if cfg.Interconnect != "" && cfg.Interconnect != routedInterconnect {
+		return fmt.Errorf("sites are not supported with interconnect %s", cfg.Interconnect)
+	}
+	for siteName, site := range cfg.Sites {
+		if _, ok := cfg.Clusters[siteName]; ok {
+			return fmt.Errorf("site %s has the name of a cluster", siteName)
+		}
+		if site.Image == "" {
+			return fmt.Errorf("site %s requires an image", siteName)
+		}
+		if _, err := subnetsIPFamily(site.Subnet); err != nil {
+			return errors.Wrapf(err, "invalid subnet for site %s", siteName)
+		}
+	}
+	return nil
+}
+
+// createSite creates the site container in its own docker network and
+// connects it to the WAN emulator of the multicluster, the site uses the
+// same gateway that the nodes of the clusters
+func createSite(name, siteName string, site SiteConfig) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	rename, err := wanRenameInterfaces(name)
+	if err != nil {
+		return err
+	}
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{siteLabel: siteName},
+	)
+	if err := docker.CreateNetwork(siteName, site.Subnet, false, labels); err != nil {
+		return err
+	}
+	gateways, err := routerAddresses(site.Subnet, 0, false)
+	if err != nil {
+		return err
+	}
+	if err := connectRouters(routers, siteName, site.Subnet, false, rename); err != nil {
+		return err
+	}
+	if len(routers) > 1 {
+		if err := configureVRRP(name); err != nil {
+			return err
+		}
+	}
+
+	args := []string{"run",
+		"-d", // run in the background
+		"--name", siteName,
+		"--hostname", siteName,
+		"--network", siteName,
+	}
+	containerLabels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.RoleLabel: siteRole},
+	)
+	args = append(args, docker.LabelArgs(containerLabels)...)
+	args = append(args, site.Image)
+	args = append(args, site.Command...)
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrapf(err, "failed to run site %s", siteName)
+	}
+	// change the default route of the site to the WAN emulator
+	for _, gateway := range gateways {
+		if err := docker.ReplaceGateway(siteName, gateway); err != nil {
+			return err
+		}
+	}
+	kindcmd.NewLogger().V(0).Infof("Created site %s with image %s", siteName, site.Image)
+	return nil
+}
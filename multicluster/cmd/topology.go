@@ -0,0 +1,257 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// topologyRoleLabel records if the cluster of the network is a hub or a spoke
+	topologyRoleLabel = "io.x-k8s.kind-networking-plugins.topology-role"
+	// topologyTransitLabel records the hub that forwards the traffic between spokes
+	topologyTransitLabel = "io.x-k8s.kind-networking-plugins.topology-transit"
+	hubRole              = "hub"
+	spokeRole            = "spoke"
+
+	// fullMeshTopology allows the traffic between any pair of clusters
+	fullMeshTopology = "full-mesh"
+	// hubAndSpokeTopology only allows the traffic between the spokes and the
+	// hubs, the traffic between spokes is dropped or forwarded by a hub
+	hubAndSpokeTopology = "hub-and-spoke"
+
+	// topologyChain is the chain of the topology rules in the WAN routers, in the
+	// mangle table so it is evaluated before the firewall rules of the filter table
+	topologyChain = "MULTICLUSTER-TOPOLOGY"
+	// topologyTable is the routing table, and the priority of its rules, used
+	// to send the traffic between spokes to the transit hub
+	topologyTable = "100"
+)
+
+// TopologyConfig defines which clusters can talk directly
+type TopologyConfig struct {
+	// Type is full-mesh, the default, or hub-and-spoke
+	Type string `yaml:"type,omitempty"`
+	// Hubs are the clusters that can talk with all the clusters in a
+	// hub-and-spoke topology, the other clusters are spokes
+	Hubs []string `yaml:"hubs,omitempty"`
+	// Transit is the hub whose gateway forwards the traffic between the
+	// spokes, if it is empty the spokes can not talk with each other
+	Transit string `yaml:"transit,omitempty"`
+}
+
+// validate checks the topology against the clusters of the configuration
+func (t TopologyConfig) validate(clusters map[string]ClusterConfig) error {
+	switch t.Type {
+	case "", fullMeshTopology:
+		if len(t.Hubs) > 0 || t.Transit != "" {
+			return fmt.Errorf("hubs are only valid in a %s topology", hubAndSpokeTopology)
+		}
+		return nil
+	case hubAndSpokeTopology:
+	default:
+		return fmt.Errorf("unknown topology %s", t.Type)
+	}
+	if len(t.Hubs) == 0 {
+		return fmt.Errorf("%s topology requires at least one hub", hubAndSpokeTopology)
+	}
+	for _, h := range t.Hubs {
+		if _, ok := clusters[h]; !ok {
+			return fmt.Errorf("hub %s not found", h)
+		}
+	}
+	if t.Transit != "" && !sliceContains(t.Hubs, t.Transit) {
+		return fmt.Errorf("transit %s is not a hub", t.Transit)
+	}
+	return nil
+}
+
+// labels returns the topology labels of the cluster network
+func (t TopologyConfig) labels(clusterName string) map[string]string {
+	if t.Type != hubAndSpokeTopology {
+		return map[string]string{}
+	}
+	if !sliceContains(t.Hubs, clusterName) {
+		return map[string]string{topologyRoleLabel: spokeRole}
+	}
+	return map[string]string{
+		topologyRoleLabel:    hubRole,
+		topologyTransitLabel: strconv.FormatBool(t.Transit == clusterName),
+	}
+}
+
+// applyTopology replaces the rules that enforce the topology in the WAN routers,
+// the topology is obtained from the labels of the clusters networks. The traffic
+// from a spoke to the other spokes is routed to the gateway of the transit hub,
+// the first node of the cluster, and the traffic forwarded directly between spokes
+// is dropped, so a spoke to spoke path never exists.
+func applyTopology(provider *cluster.Provider, name string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	spokes := []string{}
+	transit := ""
+	for _, n := range networks {
+		labels, err := docker.GetNetworkLabels(n)
+		if err != nil {
+			return err
+		}
+		if _, ok := labels[docker.ClusterLabel]; !ok {
+			continue
+		}
+		switch labels[topologyRoleLabel] {
+		case spokeRole:
+			spokes = append(spokes, n)
+		case hubRole:
+			if labels[topologyTransitLabel] == "true" {
+				transit = n
+			}
+		}
+	}
+	sort.Strings(spokes)
+
+	gateways := []string{}
+	if transit != "" && len(spokes) > 1 {
+		nodes, err := internalNodes(provider, transit)
+		if err != nil {
+			return err
+		}
+		ipv4, ipv6, err := nodes[0].IP()
+		if err != nil {
+			return err
+		}
+		for _, ip := range []string{ipv4, ipv6} {
+			if ip != "" {
+				gateways = append(gateways, ip)
+			}
+		}
+	}
+
+	for _, router := range routers {
+		ifaces := map[string]string{}
+		for _, s := range spokes {
+			ifaces[s], err = routerInterface(router, s)
+			if err != nil {
+				return err
+			}
+		}
+		if err := applyTopologyRules(router, spokes, ifaces); err != nil {
+			return err
+		}
+		if err := applyTopologyRoutes(router, spokes, ifaces, gateways); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyTopologyRules drops the traffic forwarded between the interfaces of the
+// spokes, the rules match the interfaces so they are the same for both IP families
+func applyTopologyRules(router string, spokes []string, ifaces map[string]string) error {
+	rules := [][]string{}
+	for _, from := range spokes {
+		for _, to := range spokes {
+			if from == to {
+				continue
+			}
+			rules = append(rules, []string{
+				"-i", ifaces[from], "-o", ifaces[to],
+				"-m", "comment", "--comment", fmt.Sprintf("spoke %s to spoke %s", from, to),
+				"-j", "DROP",
+			})
+		}
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		// the chain may exist if the topology was already applied
+		exec.Command("docker", "exec", router, iptables, "-t", "mangle", "-N", topologyChain).Run()
+		cmds := [][]string{{"-F", topologyChain}}
+		for _, rule := range rules {
+			cmds = append(cmds, append([]string{"-A", topologyChain}, rule...))
+		}
+		if exec.Command("docker", "exec", router, iptables, "-t", "mangle", "-C", "FORWARD", "-j", topologyChain).Run() != nil {
+			cmds = append(cmds, []string{"-I", "FORWARD", "-j", topologyChain})
+		}
+		for _, c := range cmds {
+			args := append([]string{"exec", router, iptables, "-t", "mangle"}, c...)
+			if err := exec.Command("docker", args...).Run(); err != nil {
+				return errors.Wrapf(err, "failed to run %s %s on %s", iptables, strings.Join(c, " "), router)
+			}
+		}
+	}
+	return nil
+}
+
+// applyTopologyRoutes routes the traffic that enters the router from a spoke to
+// the subnets of the other spokes through the transit hub gateways, using policy
+// routing so the traffic forwarded back by the hub follows the main table
+func applyTopologyRoutes(router string, spokes []string, ifaces map[string]string, gateways []string) error {
+	for _, family := range []string{"-4", "-6"} {
+		// delete the rules of the previous topology one by one
+		for exec.Command("docker", "exec", router, "ip", family, "rule", "del", "pref", topologyTable).Run() == nil {
+		}
+		exec.Command("docker", "exec", router, "ip", family, "route", "flush", "table", topologyTable).Run()
+	}
+	if len(gateways) == 0 {
+		return nil
+	}
+
+	cmds := [][]string{}
+	for _, gw := range gateways {
+		cmds = append(cmds, []string{"ip", "route", "replace", "default", "via", gw, "table", topologyTable})
+	}
+	for _, from := range spokes {
+		for _, to := range spokes {
+			if from == to {
+				continue
+			}
+			subnets, err := firewallSubnets(to, "")
+			if err != nil {
+				return err
+			}
+			for _, s := range subnets {
+				family := "-4"
+				if network.IsIPv6CIDR(s) {
+					family = "-6"
+				}
+				cmds = append(cmds, []string{"ip", family, "rule", "add", "pref", topologyTable,
+					"iif", ifaces[from], "to", s, "table", topologyTable})
+			}
+		}
+	}
+	for _, c := range cmds {
+		args := append([]string{"exec", router}, c...)
+		if err := exec.Command("docker", args...).Run(); err != nil {
+			return errors.Wrapf(err, "failed to run %s on %s", strings.Join(c, " "), router)
+		}
+	}
+	return nil
+}
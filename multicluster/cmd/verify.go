@@ -0,0 +1,405 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	probeNamespace   = "multicluster-verify"
+	probeName        = "probe"
+	probeServerImage = "k8s.gcr.io/e2e-test-images/agnhost:2.32"
+	probeClientImage = "curlimages/curl:7.77.0"
+	probePort        = 8080
+	// kubelet port is used to check the connectivity between nodes
+	kubeletPort = 10250
+)
+
+// probeManifest runs a web server, to be the target of the probes, and
+// a curl client, to run the probes, in the same pod, and exposes the pod
+// with a NodePort service so it can be reached through the ClusterIP too
+var probeManifest = fmt.Sprintf(`apiVersion: v1
+kind: Namespace
+metadata:
+  name: %[1]s
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+  labels:
+    app: %[2]s
+spec:
+  containers:
+  - name: server
+    image: %[3]s
+    args: ["netexec", "--http-port=%[5]d"]
+  - name: client
+    image: %[4]s
+    command: ["sleep", "infinity"]
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: %[2]s
+  namespace: %[1]s
+spec:
+  type: NodePort
+  selector:
+    app: %[2]s
+  ports:
+  - port: %[5]d
+    targetPort: %[5]d
+`, probeNamespace, probeName, probeServerImage, probeClientImage, probePort)
+
+// checks run for every ordered pair of clusters
+var verifyChecks = []string{"node-node", "pod-pod", "pod-clusterip", "pod-nodeport"}
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify the connectivity between the clusters of the multicluster",
+	Long: `Verify the connectivity between the clusters of the multicluster.
+
+Deploy a probe pod and service in every cluster and check the node to node, pod to pod,
+pod to ClusterIP and pod to NodePort connectivity for every ordered pair of clusters.
+The results are printed as a matrix with the TCP connection latency, and optionally
+written as JUnit XML. The command fails if any of the checks fails.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return verifyMultiCluster(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().String(
+		"name",
+		cluster.DefaultName,
+		"the multicluster context name",
+	)
+	verifyCmd.Flags().String(
+		"junit",
+		"",
+		"write the results as JUnit XML to this file",
+	)
+	verifyCmd.Flags().Duration(
+		"timeout",
+		5*time.Second,
+		"the timeout of each connectivity check",
+	)
+	verifyCmd.Flags().Duration(
+		"wait",
+		5*time.Minute,
+		"the time to wait for the probe pods to be ready",
+	)
+	verifyCmd.Flags().Bool(
+		"cleanup",
+		true,
+		"delete the probe pods and services after the checks",
+	)
+}
+
+// probeTarget contains the cluster addresses used as target of the probes
+type probeTarget struct {
+	cluster   string
+	node      nodes.Node
+	nodeIP    string
+	podIP     string
+	clusterIP string
+	nodePort  int
+}
+
+// verifyResult is the result of a connectivity check
+type verifyResult struct {
+	From    string
+	To      string
+	Check   string
+	Target  string
+	Latency time.Duration
+	Err     error
+}
+
+func verifyMultiCluster(cmd *cobra.Command) error {
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+	junitPath, err := cmd.Flags().GetString("junit")
+	if err != nil {
+		return err
+	}
+	timeout, err := cmd.Flags().GetDuration("timeout")
+	if err != nil {
+		return err
+	}
+	wait, err := cmd.Flags().GetDuration("wait")
+	if err != nil {
+		return err
+	}
+	cleanup, err := cmd.Flags().GetBool("cleanup")
+	if err != nil {
+		return err
+	}
+
+	logger := kindcmd.NewLogger()
+	provider := cluster.NewProvider(
+		cluster.ProviderWithLogger(logger),
+	)
+	clusters, err := provider.List()
+	if err != nil {
+		return err
+	}
+	info, err := getMultiClusterInfo(provider, name, clusters)
+	if err != nil {
+		return err
+	}
+	if len(info.Clusters) < 2 {
+		return fmt.Errorf("multicluster %s needs at least 2 clusters to verify", name)
+	}
+
+	// deploy the probes in all the clusters before waiting for them
+	controlPlanes := map[string]nodes.Node{}
+	for _, c := range info.Clusters {
+		node, err := controlPlaneNode(provider, c.Name)
+		if err != nil {
+			return err
+		}
+		controlPlanes[c.Name] = node
+		// the cleanup is registered per cluster, so the probes of the clusters
+		// already deployed are deleted if a later deployment fails, a failed
+		// apply may have created the namespace too
+		if cleanup {
+			defer kubectl(node, "delete", "namespace", probeNamespace, "--wait=false").Run()
+		}
+		logger.V(0).Infof("Deploying probes in cluster %s", c.Name)
+		if err := kubectl(node, "apply", "-f", "-").SetStdin(strings.NewReader(probeManifest)).Run(); err != nil {
+			return errors.Wrapf(err, "failed to deploy probes in cluster %s", c.Name)
+		}
+	}
+
+	targets := []probeTarget{}
+	for _, c := range info.Clusters {
+		node := controlPlanes[c.Name]
+		err := kubectl(node, "wait", "-n", probeNamespace, "--for=condition=Ready",
+			"pod/"+probeName, fmt.Sprintf("--timeout=%s", wait)).Run()
+		if err != nil {
+			return errors.Wrapf(err, "probe pod not ready in cluster %s", c.Name)
+		}
+		lines, err := exec.OutputLines(kubectl(node, "get", "-n", probeNamespace, "pod", probeName,
+			"-o", "jsonpath={.status.podIP}"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to get probe pod IP in cluster %s", c.Name)
+		}
+		if len(lines) != 1 {
+			return fmt.Errorf("unexpected probe pod IP in cluster %s: %v", c.Name, lines)
+		}
+		podIP := lines[0]
+		lines, err = exec.OutputLines(kubectl(node, "get", "-n", probeNamespace, "service", probeName,
+			"-o", "jsonpath={.spec.clusterIP} {.spec.ports[0].nodePort}"))
+		if err != nil {
+			return errors.Wrapf(err, "failed to get probe service in cluster %s", c.Name)
+		}
+		if len(lines) != 1 {
+			return fmt.Errorf("unexpected probe service in cluster %s: %v", c.Name, lines)
+		}
+		fields := strings.Fields(lines[0])
+		if len(fields) != 2 {
+			return fmt.Errorf("unexpected probe service output in cluster %s: %s", c.Name, lines[0])
+		}
+		nodePort, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return err
+		}
+		// nodes and pods are reached through their primary IP
+		nodeIP := c.Nodes[0].IPv4
+		if nodeIP == "" {
+			nodeIP = c.Nodes[0].IPv6
+		}
+		targets = append(targets, probeTarget{
+			cluster:   c.Name,
+			node:      node,
+			nodeIP:    nodeIP,
+			podIP:     podIP,
+			clusterIP: fields[0],
+			nodePort:  nodePort,
+		})
+	}
+
+	results := []verifyResult{}
+	for _, from := range targets {
+		for _, to := range targets {
+			if from.cluster == to.cluster {
+				continue
+			}
+			results = append(results, probeCluster(from, to, timeout)...)
+		}
+	}
+
+	printVerifyMatrix(cmd.OutOrStdout(), results)
+	if junitPath != "" {
+		if err := writeVerifyJUnit(junitPath, results); err != nil {
+			return err
+		}
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d connectivity checks failed", failed, len(results))
+	}
+	return nil
+}
+
+// probeCluster runs the connectivity checks from one cluster to another
+func probeCluster(from, to probeTarget, timeout time.Duration) []verifyResult {
+	results := []verifyResult{}
+	// the node connectivity is checked against the kubelet port
+	target := hostPort(to.nodeIP, kubeletPort)
+	latency, err := curlConnect(from.node.Command("curl", curlArgs("https://"+target, timeout)...))
+	results = append(results, verifyResult{From: from.cluster, To: to.cluster, Check: "node-node", Target: target, Latency: latency, Err: err})
+
+	podTargets := map[string]string{
+		"pod-pod":       hostPort(to.podIP, probePort),
+		"pod-clusterip": hostPort(to.clusterIP, probePort),
+		"pod-nodeport":  hostPort(to.nodeIP, to.nodePort),
+	}
+	for _, check := range verifyChecks[1:] {
+		target := podTargets[check]
+		args := []string{"exec", "-n", probeNamespace, probeName, "-c", "client", "--", "curl"}
+		args = append(args, curlArgs("http://"+target+"/hostname", timeout)...)
+		latency, err := curlConnect(kubectl(from.node, args...))
+		results = append(results, verifyResult{From: from.cluster, To: to.cluster, Check: check, Target: target, Latency: latency, Err: err})
+	}
+	return results
+}
+
+// curlArgs returns the curl arguments to output the time to establish the TCP connection
+func curlArgs(url string, timeout time.Duration) []string {
+	return []string{"-k", "-s", "-o", "/dev/null",
+		"-m", strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64),
+		"-w", "%{time_connect}",
+		url,
+	}
+}
+
+// curlConnect runs the curl command and returns the time to establish the TCP connection
+func curlConnect(cmd exec.Cmd) (time.Duration, error) {
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return 0, err
+	}
+	if len(lines) != 1 {
+		return 0, fmt.Errorf("unexpected curl output: %v", lines)
+	}
+	seconds, err := strconv.ParseFloat(lines[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// printVerifyMatrix prints a row per ordered pair of clusters and a column per check
+func printVerifyMatrix(out io.Writer, results []verifyResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "FROM\tTO\t%s\n", strings.ToUpper(strings.Join(verifyChecks, "\t")))
+	for i := 0; i < len(results); i += len(verifyChecks) {
+		row := results[i : i+len(verifyChecks)]
+		cells := []string{}
+		for _, r := range row {
+			if r.Err != nil {
+				cells = append(cells, "FAIL")
+			} else {
+				cells = append(cells, fmt.Sprintf("ok (%s)", r.Latency.Round(10*time.Microsecond)))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", row[0].From, row[0].To, strings.Join(cells, "\t"))
+	}
+	w.Flush()
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+}
+
+// writeVerifyJUnit writes the results of the checks as JUnit XML
+func writeVerifyJUnit(path string, results []verifyResult) error {
+	suite := junitTestSuite{
+		Name:  "multicluster-verify",
+		Tests: len(results),
+	}
+	for _, r := range results {
+		tc := junitTestCase{
+			Name:      fmt.Sprintf("%s from %s to %s (%s)", r.Check, r.From, r.To, r.Target),
+			Classname: "multicluster.verify",
+			Time:      strconv.FormatFloat(r.Latency.Seconds(), 'f', 6, 64),
+		}
+		if r.Err != nil {
+			suite.Failures++
+			tc.Failure = &junitFailure{Message: r.Err.Error()}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	b, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), b...), 0644)
+}
+
+func hostPort(ip string, port int) string {
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
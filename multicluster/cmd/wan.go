@@ -17,35 +17,315 @@ package cmd
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strings"
 
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/network"
+
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	routerRole = "router"
+	// renameInterfacesLabel records in the routers if their interfaces
+	// are named after the clusters
+	renameInterfacesLabel = "io.x-k8s.kind-networking-plugins.rename-interfaces"
+
+	vrrpConfig = "/etc/keepalived/keepalived.conf"
+	vrrpPid    = "/run/keepalived.pid"
 )
 
+// vrrpInstance is the keepalived configuration of the gateway IP of a cluster
+// network, the virtual router id only needs to be unique per network segment
+const vrrpInstance = `vrrp_instance %[1]s {
+  state BACKUP
+  interface %[2]s
+  virtual_router_id %[3]d
+  priority %[4]d
+  advert_int 1
+  virtual_ipaddress {
+    %[5]s dev %[2]s
+  }
+}
+`
+
 // wanCmd represents the wan command
 var wanCmd = &cobra.Command{
 	Use:   "wan",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Manage the WAN emulator of the multicluster",
+	Long: `Manage the WAN emulator of the multicluster.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("wan called")
-	},
+The WAN emulator is the router that connects the networks of the clusters,
+or a pair of routers sharing the gateway IPs with VRRP if the multicluster
+was created with a highly available WAN.`,
 }
 
 func init() {
 	rootCmd.AddCommand(wanCmd)
+}
+
+// wanemRouters returns the routers of the WAN emulator, the primary router first
+func wanemRouters(name string) ([]string, error) {
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.RoleLabel: routerRole},
+	)
+	routers, err := docker.ListContainersByLabel(labels)
+	if err != nil {
+		return nil, err
+	}
+	if len(routers) == 0 {
+		return nil, fmt.Errorf("WAN emulator of multicluster %s not found", name)
+	}
+	// the primary router wan-<name> sorts before the backup wan-<name>-backup
+	sort.Strings(routers)
+	return routers, nil
+}
+
+// routerAddresses returns the addresses of the router on the network, one per
+// subnet. The primary router of a non HA WAN owns the gateway IPs, the last
+// IPs of the subnets, otherwise the routers use the previous IPs and the
+// gateway IPs are managed by VRRP.
+func routerAddresses(subnet string, index int, ha bool) ([]string, error) {
+	ips := []string{}
+	for _, s := range strings.Split(subnet, ",") {
+		gateway, err := network.GetLastIPSubnet(s)
+		if err != nil {
+			return nil, err
+		}
+		if ha {
+			gateway = network.AddIPOffset(gateway, -1-index)
+		}
+		ips = append(ips, gateway.String())
+	}
+	return ips, nil
+}
+
+// routerInterface returns the interface of the router connected to the network
+func routerInterface(router, networkName string) (string, error) {
+	mac, err := docker.GetContainerMAC(router, networkName)
+	if err != nil {
+		return "", err
+	}
+	// output format: 3: eth1@if24: <BROADCAST,MULTICAST,UP,LOWER_UP> mtu 1500 ... link/ether 02:42:ac:58:00:02 brd ...
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", router, "ip", "-o", "link", "show"))
+	if err != nil {
+		return "", err
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		for i, f := range fields {
+			if f == "link/ether" && i+1 < len(fields) && fields[i+1] == mac {
+				// interfaces connected through veths show as eth1@if24
+				return strings.Split(strings.TrimSuffix(fields[1], ":"), "@")[0], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("interface with MAC %s not found on %s", mac, router)
+}
+
+// maxInterfaceName is the maximum length of a Linux interface name, IFNAMSIZ - 1
+const maxInterfaceName = 15
+
+// wanRenameInterfaces returns true if the router interfaces are named after the clusters
+func wanRenameInterfaces(name string) (bool, error) {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return false, err
+	}
+	labels, err := docker.GetContainerLabels(routers[0])
+	if err != nil {
+		return false, err
+	}
+	return labels[renameInterfacesLabel] == "true", nil
+}
 
-	// Here you will define your flags and configuration settings.
+// validateRenameInterfaces checks that the cluster names are valid interface names
+func validateRenameInterfaces(clusters []string) error {
+	for _, c := range clusters {
+		if len(c) > maxInterfaceName || strings.ContainsAny(c, "/: ") {
+			return fmt.Errorf("name %s is not a valid interface name to rename the router interfaces", c)
+		}
+	}
+	return nil
+}
+
+// renameRouterInterface names the interface of the router connected to the network
+// after the cluster. The name given by docker is kept as the interface alias, so
+// it can be restored before disconnecting the network, docker removes the interface
+// by its name.
+func renameRouterInterface(router, networkName, clusterName string) error {
+	iface, err := routerInterface(router, networkName)
+	if err != nil {
+		return err
+	}
+	if iface == clusterName {
+		return nil
+	}
+	return setRouterInterfaceName(router, iface, clusterName, iface)
+}
+
+// restoreRouterInterfaceName restores the name given by docker to the interface
+// of the router connected to the network, if it was renamed
+func restoreRouterInterfaceName(router, networkName string) error {
+	iface, err := routerInterface(router, networkName)
+	if err != nil {
+		return err
+	}
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", router, "cat", "/sys/class/net/"+iface+"/ifalias"))
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 || lines[0] == "" || lines[0] == iface {
+		return nil
+	}
+	return setRouterInterfaceName(router, iface, lines[0], "")
+}
+
+// setRouterInterfaceName renames the interface of the router and sets its alias,
+// the interface has to be down to be renamed so the IPv6 addresses are kept on down
+func setRouterInterfaceName(router, iface, newName, alias string) error {
+	cmds := [][]string{
+		{"sysctl", "-w", "net.ipv6.conf." + iface + ".keep_addr_on_down=1"},
+		{"ip", "link", "set", "dev", iface, "down"},
+		{"ip", "link", "set", "dev", iface, "name", newName, "alias", alias},
+		{"ip", "link", "set", "dev", newName, "up"},
+	}
+	for _, c := range cmds {
+		args := append([]string{"exec", router}, c...)
+		if err := exec.Command("docker", args...).Run(); err != nil {
+			return errors.Wrapf(err, "failed to rename interface %s to %s on %s", iface, newName, router)
+		}
+	}
+	return nil
+}
+
+// RouterInterfaceInfo describes the interface of a router connected to a cluster network
+type RouterInterfaceInfo struct {
+	Router        string `json:"router" yaml:"router"`
+	Interface     string `json:"interface" yaml:"interface"`
+	MAC           string `json:"mac" yaml:"mac"`
+	HostInterface string `json:"hostInterface" yaml:"hostInterface"`
+}
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// wanCmd.PersistentFlags().String("foo", "", "A help for foo")
+// routerInterfaceInfo returns the interface of the router connected to the network,
+// its MAC and the veth peer of the interface on the host
+func routerInterfaceInfo(router, networkName string) (RouterInterfaceInfo, error) {
+	info := RouterInterfaceInfo{Router: router}
+	var err error
+	info.MAC, err = docker.GetContainerMAC(router, networkName)
+	if err != nil {
+		return info, err
+	}
+	info.Interface, err = routerInterface(router, networkName)
+	if err != nil {
+		return info, err
+	}
+	info.HostInterface, err = docker.GetContainerHostIface(router, info.Interface)
+	return info, err
+}
+
+// routerHasIP returns true if the IP address is configured in the router
+func routerHasIP(router string, ip net.IP) (bool, error) {
+	// output format: 3: eth1    inet 172.88.255.254/16 brd 172.88.255.255 scope global eth1
+	lines, err := exec.OutputLines(exec.Command("docker", "exec", router, "ip", "-o", "addr", "show"))
+	if err != nil {
+		return false, err
+	}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) < 4 {
+			continue
+		}
+		addr, _, err := net.ParseCIDR(fields[3])
+		if err == nil && addr.Equal(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// configureVRRP configures keepalived in the routers of the WAN emulator to
+// share the gateway IPs of all the networks, the primary router has the
+// highest priority so it owns the gateway IPs while it is alive.
+func configureVRRP(name string) error {
+	routers, err := wanemRouters(name)
+	if err != nil {
+		return err
+	}
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	sort.Strings(networks)
+
+	for i, router := range routers {
+		// the router image may have been overwritten with one without keepalived
+		if err := exec.Command("docker", "exec", router, "sh", "-c", "command -v keepalived").Run(); err != nil {
+			return fmt.Errorf("keepalived not found in router %s, the highly available WAN requires the image %s built with make images", router, dockerWanHAImage)
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "global_defs {\n  router_id %s\n  vrrp_version 3\n}\n", router)
+		for _, n := range networks {
+			iface, err := routerInterface(router, n)
+			if err != nil {
+				// the router is not connected to this network
+				continue
+			}
+			subnets, err := docker.GetNetworkSubnets(n)
+			if err != nil {
+				return err
+			}
+			for _, subnet := range subnets {
+				gateway, err := network.GetLastIPSubnet(subnet)
+				if err != nil {
+					return err
+				}
+				_, cidr, err := net.ParseCIDR(subnet)
+				if err != nil {
+					return err
+				}
+				ones, _ := cidr.Mask.Size()
+				instance, vrid := n+"-ipv4", 51
+				if network.IsIPv6CIDR(subnet) {
+					instance, vrid = n+"-ipv6", 52
+				}
+				vip := fmt.Sprintf("%s/%d", gateway, ones)
+				fmt.Fprintf(&b, vrrpInstance, instance, iface, vrid, 150-50*i, vip)
+			}
+		}
+		err := exec.Command("docker", "exec", "-i", router, "sh", "-c", "mkdir -p /etc/keepalived && cat > "+vrrpConfig).
+			SetStdin(strings.NewReader(b.String())).Run()
+		if err != nil {
+			return errors.Wrapf(err, "failed to write keepalived config in %s", router)
+		}
+		if err := startVRRP(router); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startVRRP starts keepalived in the router or reloads its configuration if running
+func startVRRP(router string) error {
+	script := fmt.Sprintf("if [ -f %[1]s ] && kill -HUP $(cat %[1]s) 2>/dev/null; then exit 0; fi; keepalived -f %[2]s -p %[1]s",
+		vrrpPid, vrrpConfig)
+	if err := exec.Command("docker", "exec", router, "sh", "-c", script).Run(); err != nil {
+		return errors.Wrapf(err, "failed to start keepalived in %s", router)
+	}
+	return nil
+}
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// wanCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+// stopVRRP stops keepalived in the router, that releases the gateway IPs
+func stopVRRP(router string) error {
+	script := fmt.Sprintf("kill -TERM $(cat %[1]s) && rm -f %[1]s", vrrpPid)
+	if err := exec.Command("docker", "exec", router, "sh", "-c", script).Run(); err != nil {
+		return errors.Wrapf(err, "failed to stop keepalived in %s", router)
+	}
+	return nil
 }
@@ -0,0 +1,341 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// bench is a TCP and UDP throughput and latency tool used by the
+// multicluster plugin to measure the performance of the WAN path.
+//
+// The server listens on the same port for TCP and UDP, TCP connections
+// start with one byte with the test mode: 'T' to discard the data sent
+// and reply with the number of bytes received, and 'P' to echo the
+// messages. UDP datagrams are echoed back to the sender.
+//
+// The client runs the test against the server and writes the result
+// as JSON to stdout.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	modeThroughput = 'T'
+	modePing       = 'P'
+	// pingSize is the size of the messages used to measure the TCP RTT
+	pingSize = 64
+	// udpSize is the size of the UDP datagrams, below the usual 1500 MTU
+	udpSize = 1400
+)
+
+// Result is the result of a benchmark
+type Result struct {
+	Protocol string `json:"protocol"`
+	Server   string `json:"server"`
+	// Duration of the throughput test in seconds
+	Duration float64 `json:"duration"`
+	// Bytes received by the server (TCP) or echoed back to the client (UDP)
+	Bytes uint64 `json:"bytes"`
+	// Throughput in bits per second
+	Throughput float64 `json:"throughput"`
+	// RTT percentiles in milliseconds
+	RTT RTT `json:"rtt"`
+	// Retransmits is the number of TCP segments retransmitted
+	Retransmits uint32 `json:"retransmits"`
+	// Loss is the percentage of UDP datagrams lost
+	Loss float64 `json:"loss"`
+}
+
+// RTT contains the round trip time percentiles in milliseconds
+type RTT struct {
+	Min float64 `json:"min"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s server|client [flags]\n", os.Args[0])
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "server":
+		err = server(os.Args[2:])
+	case "client":
+		err = client(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %s", os.Args[1])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func server(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	port := fs.Int("port", 5201, "the TCP and UDP port to listen on")
+	fs.Parse(args)
+
+	addr := fmt.Sprintf(":%d", *port)
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, peer, err := udp.ReadFrom(buf)
+			if err != nil {
+				log.Printf("udp read error: %v", err)
+				continue
+			}
+			udp.WriteTo(buf[:n], peer)
+		}
+	}()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening on %s", addr)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+	mode := make([]byte, 1)
+	if _, err := io.ReadFull(conn, mode); err != nil {
+		return
+	}
+	switch mode[0] {
+	case modeThroughput:
+		n, _ := io.Copy(io.Discard, conn)
+		binary.Write(conn, binary.BigEndian, uint64(n))
+	case modePing:
+		io.Copy(conn, conn)
+	}
+}
+
+func client(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	serverAddr := fs.String("server", "", "the server address host:port")
+	protocol := fs.String("protocol", "tcp", "the protocol to test: tcp or udp")
+	duration := fs.Duration("duration", 10*time.Second, "the duration of the throughput test")
+	pings := fs.Int("pings", 100, "the number of messages to measure the TCP RTT")
+	rate := fs.Float64("rate", 100e6, "the UDP sending rate in bits per second")
+	fs.Parse(args)
+
+	if *serverAddr == "" {
+		return fmt.Errorf("server address is required")
+	}
+	var result *Result
+	var err error
+	switch *protocol {
+	case "tcp":
+		result, err = clientTCP(*serverAddr, *duration, *pings)
+	case "udp":
+		result, err = clientUDP(*serverAddr, *duration, *rate)
+	default:
+		err = fmt.Errorf("unsupported protocol %s", *protocol)
+	}
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(result)
+}
+
+func clientTCP(server string, duration time.Duration, pings int) (*Result, error) {
+	result := &Result{Protocol: "tcp", Server: server}
+
+	// measure the RTT with small messages on their own connection
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	conn.(*net.TCPConn).SetNoDelay(true)
+	if _, err := conn.Write([]byte{modePing}); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, pingSize)
+	samples := []time.Duration{}
+	for i := 0; i < pings; i++ {
+		start := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return nil, err
+		}
+		samples = append(samples, time.Since(start))
+	}
+	conn.Close()
+	result.RTT = percentiles(samples)
+
+	// send as much data as possible during the test duration
+	conn, err = net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	tcpConn := conn.(*net.TCPConn)
+	if _, err := conn.Write([]byte{modeThroughput}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 128*1024)
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := conn.Write(buf); err != nil {
+			return nil, err
+		}
+	}
+	tcpConn.CloseWrite()
+	// the server replies with the bytes received once all the data is read
+	var received uint64
+	if err := binary.Read(conn, binary.BigEndian, &received); err != nil {
+		return nil, err
+	}
+	elapsed := time.Since(start)
+	result.Duration = elapsed.Seconds()
+	result.Bytes = received
+	result.Throughput = float64(received) * 8 / elapsed.Seconds()
+	result.Retransmits, err = tcpRetransmits(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// tcpRetransmits returns the total number of segments retransmitted in the connection
+func tcpRetransmits(conn *net.TCPConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var info *unix.TCPInfo
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		info, sockErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, sockErr
+	}
+	return info.Total_retrans, nil
+}
+
+func clientUDP(server string, duration time.Duration, rate float64) (*Result, error) {
+	result := &Result{Protocol: "udp", Server: server}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// each datagram carries its sequence number and the time it was sent
+	var mu sync.Mutex
+	samples := []time.Duration{}
+	var received uint64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65535)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if n < 16 {
+				continue
+			}
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:16])))
+			mu.Lock()
+			samples = append(samples, time.Since(sent))
+			received += uint64(n)
+			mu.Unlock()
+		}
+	}()
+
+	interval := time.Duration(float64(udpSize*8) / rate * float64(time.Second))
+	buf := make([]byte, udpSize)
+	var sent uint64
+	start := time.Now()
+	for next := start; time.Since(start) < duration; next = next.Add(interval) {
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+		binary.BigEndian.PutUint64(buf[0:8], sent)
+		binary.BigEndian.PutUint64(buf[8:16], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(buf); err != nil {
+			return nil, err
+		}
+		sent++
+	}
+	elapsed := time.Since(start)
+	// wait for the datagrams in flight before closing the connection
+	time.Sleep(2 * time.Second)
+	conn.Close()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	result.Duration = elapsed.Seconds()
+	result.Bytes = received
+	result.Throughput = float64(received) * 8 / elapsed.Seconds()
+	result.RTT = percentiles(samples)
+	if sent > 0 {
+		result.Loss = 100 * (1 - float64(len(samples))/float64(sent))
+	}
+	return result, nil
+}
+
+func percentiles(samples []time.Duration) RTT {
+	if len(samples) == 0 {
+		return RTT{}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	ms := func(p float64) float64 {
+		i := int(p * float64(len(samples)-1))
+		return float64(samples[i]) / float64(time.Millisecond)
+	}
+	return RTT{
+		Min: ms(0),
+		P50: ms(0.50),
+		P90: ms(0.90),
+		P99: ms(0.99),
+		Max: ms(1),
+	}
+}
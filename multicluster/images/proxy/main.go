@@ -0,0 +1,50 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// proxy is the HTTP proxy of the clusters of the multicluster plugin, it
+// runs in the network namespace of each WAN router, the only path of the
+// clusters to internet when the proxy is enabled, and logs every request.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/aojea/kind-networking-plugins/pkg/proxy"
+)
+
+func main() {
+	port := flag.Int("port", 3128, "the port the proxy listens on")
+	flag.Parse()
+
+	server := &http.Server{
+		Addr: net.JoinHostPort("", strconv.Itoa(*port)),
+		Handler: &proxy.Proxy{
+			Log: func(method, host string, err error) {
+				if err != nil {
+					log.Printf("%s %s: %v", method, host, err)
+					return
+				}
+				log.Printf("%s %s", method, host)
+			},
+		},
+	}
+	log.Printf("HTTP proxy listening on port %d", *port)
+	log.Fatal(server.ListenAndServe())
+}
@@ -25,10 +25,15 @@ import (
 
 	"sigs.k8s.io/kind/pkg/apis/config/v1alpha4"
 	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
 )
 
-const topologyLabel = "topology.kubernetes.io/zone"
+const (
+	topologyLabel = "topology.kubernetes.io/zone"
+	// pluginName is used to label the resources owned by the plugin
+	pluginName = "multizone"
+)
 
 // createCmd represents the create command
 var createCmd = &cobra.Command{
@@ -60,6 +65,11 @@ func init() {
 		1,
 		"the number of nodes pes zone (default 1)",
 	)
+	createCmd.Flags().StringSlice(
+		"images",
+		[]string{},
+		"image tarballs or local images loaded in the nodes, the node image has to be local or loaded",
+	)
 }
 
 func createMultiZone(cmd *cobra.Command) error {
@@ -75,6 +85,30 @@ func createMultiZone(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	imageArgs, err := cmd.Flags().GetStringSlice("images")
+	if err != nil {
+		return err
+	}
+	config := &v1alpha4.Cluster{
+		Name:  name,
+		Nodes: createNodes(zones, nodeZones),
+		// We want TopologyHints to test multizone available in 1.22+
+		FeatureGates: map[string]bool{
+			"TopologyAwareHints": true,
+		},
+	}
+	// load the images before creating anything, so
+	// creating the cluster offline fails fast
+	images := []string{}
+	if len(imageArgs) > 0 {
+		images, err = docker.LoadImages(imageArgs)
+		if err != nil {
+			return err
+		}
+		if err := docker.CheckImages(docker.NodeImages(config)); err != nil {
+			return err
+		}
+	}
 	// create the clusters
 	logger := kindcmd.NewLogger()
 	provider := cluster.NewProvider(
@@ -83,7 +117,11 @@ func createMultiZone(cmd *cobra.Command) error {
 	clusterNetwork := "multiz-" + name
 	// use a separate network for the cluster
 	// autoallocate subnet and allow masquerading
-	err = docker.CreateNetwork(clusterNetwork, "", true)
+	labels := docker.MergeLabels(
+		docker.OwnerLabels(pluginName, name),
+		map[string]string{docker.ClusterLabel: name},
+	)
+	err = docker.CreateNetwork(clusterNetwork, "", true, labels)
 	if err != nil {
 		return err
 	}
@@ -91,15 +129,6 @@ func createMultiZone(cmd *cobra.Command) error {
 	// use the new created docker network
 	os.Setenv("KIND_EXPERIMENTAL_DOCKER_NETWORK", clusterNetwork)
 
-	config := &v1alpha4.Cluster{
-		Name:  name,
-		Nodes: createNodes(zones, nodeZones),
-		// We want TopologyHints to test multizone available in 1.22+
-		FeatureGates: map[string]bool{
-			"TopologyAwareHints": true,
-		},
-	}
-
 	// create the cluster
 	if err := provider.Create(
 		name,
@@ -116,6 +145,19 @@ func createMultiZone(cmd *cobra.Command) error {
 	// reset the env variable
 	os.Unsetenv("KIND_EXPERIMENTAL_DOCKER_NETWORK")
 
+	// load the images in the nodes, like kind load
+	allNodes, err := provider.ListNodes(name)
+	if err != nil {
+		return err
+	}
+	nodes, err := nodeutils.InternalNodes(allNodes)
+	if err != nil {
+		return err
+	}
+	if err := docker.LoadNodeImages(nodes, images); err != nil {
+		return err
+	}
+
 	// create zones bridges
 
 	return nil
@@ -59,19 +59,54 @@ func deleteMultiCluster(cmd *cobra.Command) error {
 		return err
 	}
 
-	for _, cluster := range clusters {
-		if cluster == name {
-			if err = provider.Delete(cluster, ""); err != nil {
-				logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", cluster))
-				continue
-			}
-			logger.V(0).Infof("Deleted clusters: %q", cluster)
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	// delete the cluster attached to the networks first
+	// so the networks don't have containers attached
+	for _, network := range networks {
+		labels, err := docker.GetNetworkLabels(network)
+		if err != nil {
+			return err
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if !ok || !sliceContains(clusters, clusterName) {
+			continue
+		}
+		if err = provider.Delete(clusterName, ""); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete cluster %q", clusterName))
+			continue
+		}
+		// the cluster may be attached to multiple networks
+		clusters = removeFromSlice(clusters, clusterName)
+		logger.V(0).Infof("Deleted clusters: %q", clusterName)
+	}
+	for _, network := range networks {
+		if err = docker.DeleteNetwork(network); err != nil {
+			logger.V(0).Infof("%s\n", errors.Wrapf(err, "failed to delete network %q", network))
+			continue
 		}
 	}
-	clusterNetwork := "multiz-" + name
-	// delete zones bridges and network
-	docker.DeleteNetwork(clusterNetwork)
-
 	// TODO accumulate errors
 	return nil
 }
+
+func sliceContains(slice []string, a string) bool {
+	for _, s := range slice {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFromSlice(slice []string, a string) []string {
+	out := []string{}
+	for _, s := range slice {
+		if a != s {
+			out = append(out, s)
+		}
+	}
+	return out
+}
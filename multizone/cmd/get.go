@@ -17,22 +17,29 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+	"github.com/aojea/kind-networking-plugins/pkg/topology"
+	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"sigs.k8s.io/kind/pkg/cluster"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
 	kindcmd "sigs.k8s.io/kind/pkg/cmd"
+	"sigs.k8s.io/kind/pkg/exec"
 )
 
 // getCmd represents the get command
 var getCmd = &cobra.Command{
 	Use:   "get",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Short: "Get the multizone cluster",
+	Long: `Get the multizone cluster.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+By default it prints the cluster found, the dot and mermaid outputs render
+the topology as a Graphviz or Mermaid diagram: the cluster network with its
+subnets, and the nodes with their zones and IPs.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return getMultiCluster(cmd)
 	},
@@ -45,7 +52,12 @@ func init() {
 		cluster.DefaultName,
 		"the multicluster context name",
 	)
-
+	getCmd.Flags().StringP(
+		"output",
+		"o",
+		"",
+		"output format: dot or mermaid, by default the clusters found are printed",
+	)
 }
 
 func getMultiCluster(cmd *cobra.Command) error {
@@ -53,6 +65,13 @@ func getMultiCluster(cmd *cobra.Command) error {
 	if err != nil {
 		return err
 	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	if output != "" && !topology.IsFormat(output) {
+		return fmt.Errorf("unsupported output format %q", output)
+	}
 
 	logger := kindcmd.NewLogger()
 
@@ -64,10 +83,86 @@ func getMultiCluster(cmd *cobra.Command) error {
 		return err
 	}
 
-	for _, cluster := range clusters {
-		if cluster == name {
-			fmt.Println("Cluster found:", cluster)
+	// the cluster is found through the labels of its networks
+	networks, err := docker.ListNetworksByLabel(docker.OwnerLabels(pluginName, name))
+	if err != nil {
+		return err
+	}
+	found := []string{}
+	for _, network := range networks {
+		labels, err := docker.GetNetworkLabels(network)
+		if err != nil {
+			return err
+		}
+		clusterName, ok := labels[docker.ClusterLabel]
+		if ok && sliceContains(clusters, clusterName) && !sliceContains(found, clusterName) {
+			if output == "" {
+				fmt.Println("Cluster found:", clusterName)
+			}
+			found = append(found, clusterName)
+		}
+	}
+	if output == "" {
+		return nil
+	}
+	g, err := getGraph(provider, name, networks, found)
+	if err != nil {
+		return err
+	}
+	return topology.Write(cmd.OutOrStdout(), g, output)
+}
+
+// getGraph obtains the topology diagram of the cluster,
+// the nodes are labeled with the zone they belong to
+func getGraph(provider *cluster.Provider, name string, networks, clusters []string) (*topology.Graph, error) {
+	sort.Strings(networks)
+	g := &topology.Graph{Name: name}
+	var err error
+	g.Networks, err = topology.NewNetworks(networks)
+	if err != nil {
+		return nil, err
+	}
+	for _, clusterName := range clusters {
+		allNodes, err := provider.ListNodes(clusterName)
+		if err != nil {
+			return nil, err
+		}
+		c, err := topology.NewCluster(clusterName, allNodes, networks)
+		if err != nil {
+			return nil, err
+		}
+		zones, err := nodeZones(allNodes)
+		if err != nil {
+			return nil, err
+		}
+		for i := range c.Nodes {
+			c.Nodes[i].Zone = zones[c.Nodes[i].Name]
+		}
+		g.Clusters = append(g.Clusters, c)
+	}
+	return g, nil
+}
+
+// nodeZones returns the zone of each Kubernetes node, obtained
+// from the topology label of the nodes in the API server
+func nodeZones(allNodes []nodes.Node) (map[string]string, error) {
+	node, err := nodeutils.BootstrapControlPlaneNode(allNodes)
+	if err != nil {
+		return nil, err
+	}
+	jsonpath := fmt.Sprintf(`{range .items[*]}{.metadata.name}{" "}{.metadata.labels.%s}{"\n"}{end}`,
+		strings.ReplaceAll(topologyLabel, ".", `\.`))
+	lines, err := exec.OutputLines(node.Command("kubectl", "--kubeconfig=/etc/kubernetes/admin.conf",
+		"get", "nodes", "-o", "jsonpath="+jsonpath))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the nodes zones")
+	}
+	zones := map[string]string{}
+	for _, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) == 2 {
+			zones[fields[0]] = fields[1]
 		}
 	}
-	return nil
+	return zones, nil
 }
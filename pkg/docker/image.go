@@ -0,0 +1,139 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"sigs.k8s.io/kind/pkg/apis/config/defaults"
+	"sigs.k8s.io/kind/pkg/apis/config/v1alpha4"
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+	"sigs.k8s.io/kind/pkg/cluster/nodeutils"
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+// LoadImages makes the images available in the host, each image is a tarball,
+// as created by docker save, or the name of a local image, it returns the
+// names of the images, or their IDs if they have no name, and fails if an
+// image is neither local nor loadable
+func LoadImages(images []string) ([]string, error) {
+	loaded := []string{}
+	for _, image := range images {
+		if info, err := os.Stat(image); err == nil && !info.IsDir() {
+			names, ids, err := LoadImageArchive(image)
+			if err != nil {
+				return nil, err
+			}
+			loaded = append(loaded, names...)
+			loaded = append(loaded, ids...)
+			continue
+		}
+		if !ImageExists(image) {
+			return nil, fmt.Errorf("image %s is neither a local image nor an image tarball", image)
+		}
+		loaded = append(loaded, image)
+	}
+	return loaded, nil
+}
+
+// LoadImageArchive loads the images of the tarball in the host and
+// returns their names, and the IDs of the images without name
+func LoadImageArchive(path string) ([]string, []string, error) {
+	// output format: Loaded image: nginx:1.21
+	// or Loaded image ID: sha256:... if the image has no name
+	lines, err := exec.OutputLines(exec.Command("docker", "load", "--input", path))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to load images from %s", path)
+	}
+	names, ids := []string{}, []string{}
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "Loaded image ID: "):
+			ids = append(ids, strings.TrimPrefix(l, "Loaded image ID: "))
+		case strings.HasPrefix(l, "Loaded image: "):
+			names = append(names, strings.TrimPrefix(l, "Loaded image: "))
+		}
+	}
+	return names, ids, nil
+}
+
+// ImageExists returns true if the image is available in the host
+func ImageExists(image string) bool {
+	return exec.Command("docker", "image", "inspect", image).Run() == nil
+}
+
+// CheckImages fails if any of the images is not available in the host
+func CheckImages(images []string) error {
+	missing := []string{}
+	for _, image := range images {
+		if !ImageExists(image) && !contains(missing, image) {
+			missing = append(missing, image)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("images %s are not available locally", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// NodeImages returns the node images of the cluster configuration
+func NodeImages(config *v1alpha4.Cluster) []string {
+	// kind creates a control plane node if the configuration has no nodes
+	if len(config.Nodes) == 0 {
+		return []string{defaults.Image}
+	}
+	images := []string{}
+	for _, n := range config.Nodes {
+		node := n.DeepCopy()
+		v1alpha4.SetDefaultsNode(node)
+		if !contains(images, node.Image) {
+			images = append(images, node.Image)
+		}
+	}
+	return images
+}
+
+// LoadNodeImages loads the images of the host in the nodes, like kind load
+func LoadNodeImages(nodeList []nodes.Node, images []string) error {
+	if len(nodeList) == 0 || len(images) == 0 {
+		return nil
+	}
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "images.tar")
+	args := append([]string{"save", "-o", archive}, images...)
+	if err := exec.Command("docker", args...).Run(); err != nil {
+		return errors.Wrap(err, "failed to save images")
+	}
+	for _, n := range nodeList {
+		if err := loadNodeImageArchive(n, archive); err != nil {
+			return errors.Wrapf(err, "failed to load images in node %s", n.String())
+		}
+	}
+	return nil
+}
+
+func loadNodeImageArchive(n nodes.Node, archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return nodeutils.LoadImageArchive(n, f)
+}
+
+func contains(slice []string, a string) bool {
+	for _, s := range slice {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	"sigs.k8s.io/kind/pkg/exec"
+)
+
+const (
+	// PluginLabel is the label with the name of the plugin that owns the resource
+	PluginLabel = "io.x-k8s.kind-networking-plugins.plugin"
+	// TopologyLabel is the label with the name of the topology that owns the resource
+	TopologyLabel = "io.x-k8s.kind-networking-plugins.topology"
+	// ClusterLabel is the label with the name of the KIND cluster attached to a network
+	ClusterLabel = "io.x-k8s.kind-networking-plugins.cluster"
+	// RoleLabel is the label with the function of the containers created by the plugins
+	RoleLabel = "io.x-k8s.kind-networking-plugins.role"
+)
+
+// OwnerLabels returns the labels that identify the resources of a topology
+func OwnerLabels(plugin, topology string) map[string]string {
+	return map[string]string{
+		PluginLabel:   plugin,
+		TopologyLabel: topology,
+	}
+}
+
+// MergeLabels returns a new map with the labels of all the maps passed
+func MergeLabels(labels ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, l := range labels {
+		for k, v := range l {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// ListNetworksByLabel returns the docker networks that have all the labels passed
+func ListNetworksByLabel(labels map[string]string) ([]string, error) {
+	args := []string{"network", "list", "--format", `{{ .Name }}`}
+	args = append(args, labelFilterArgs(labels)...)
+	return exec.OutputLines(exec.Command("docker", args...))
+}
+
+// ListContainersByLabel returns the docker containers, running or not,
+// that have all the labels passed
+func ListContainersByLabel(labels map[string]string) ([]string, error) {
+	args := []string{"ps", "-a", "--format", `{{ .Names }}`}
+	args = append(args, labelFilterArgs(labels)...)
+	return exec.OutputLines(exec.Command("docker", args...))
+}
+
+// GetNetworkLabels returns the labels of the docker network
+func GetNetworkLabels(name string) (map[string]string, error) {
+	cmd := exec.Command("docker", "network", "inspect",
+		"--format", `{{ json .Labels }}`, name)
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error trying to get network %s labels", name)
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("network %s labels should only be one line, got %d lines", name, len(lines))
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(lines[0]), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// GetContainerLabels returns the labels of the docker container
+func GetContainerLabels(name string) (map[string]string, error) {
+	cmd := exec.Command("docker", "inspect",
+		"--format", `{{ json .Config.Labels }}`, name)
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error trying to get container %s labels", name)
+	}
+	if len(lines) != 1 {
+		return nil, fmt.Errorf("container %s labels should only be one line, got %d lines", name, len(lines))
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(lines[0]), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// DeleteContainer removes the container and its volumes
+func DeleteContainer(name string) error {
+	return exec.Command("docker", "rm", "-f", "-v", name).Run()
+}
+
+// LabelArgs returns the docker arguments to set the labels,
+// sorted so the command line is stable
+func LabelArgs(labels map[string]string) []string {
+	args := []string{}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--label", fmt.Sprintf("%s=%s", k, labels[k]))
+	}
+	return args
+}
+
+// labelFilterArgs returns the docker arguments to filter by the labels
+func labelFilterArgs(labels map[string]string) []string {
+	args := []string{}
+	for _, k := range sortedKeys(labels) {
+		args = append(args, "--filter", fmt.Sprintf("label=%s=%s", k, labels[k]))
+	}
+	return args
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/vishvananda/netlink"
@@ -14,21 +15,46 @@ import (
 )
 
 // CreateNetwork create a docker network with the passed parameters
-func CreateNetwork(name, subnet string, masquerade bool) error {
+// the subnet can be a comma separated list of IPv4 and IPv6 subnets
+func CreateNetwork(name, subnet string, masquerade bool, labels map[string]string) error {
+	return createNetwork(name, subnet, true, masquerade, labels)
+}
+
+// CreateSharedNetwork creates a docker network like CreateNetwork, but the
+// containers get IPs from the whole subnet so many clusters can share it
+func CreateSharedNetwork(name, subnet string, masquerade bool, labels map[string]string) error {
+	return createNetwork(name, subnet, false, masquerade, labels)
+}
+
+func createNetwork(name, subnet string, limitRange, masquerade bool, labels map[string]string) error {
 	args := []string{"network", "create", "-d=bridge"}
+	// label the network so it can be found without the original config
+	args = append(args, LabelArgs(labels)...)
 	// enable docker iptables rules to masquerade network traffic
 	args = append(args, "-o", fmt.Sprintf("com.docker.network.bridge.enable_ip_masquerade=%t", masquerade))
 	// configure the subnet and the gateway provided
 	if subnet != "" {
-		args = append(args, "--subnet", subnet)
-		// and only allocate ips for the containers for the first 32 ips /27
-		_, cidr, err := net.ParseCIDR(subnet)
-		if err != nil {
-			return err
+		ipv6 := false
+		for _, s := range strings.Split(subnet, ",") {
+			args = append(args, "--subnet", s)
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				return err
+			}
+			// and only allocate ips for the containers for the first 32 ips
+			// /27 for IPv4 and /123 for IPv6
+			if limitRange {
+				_, bits := cidr.Mask.Size()
+				ipRange := &net.IPNet{IP: cidr.IP, Mask: net.CIDRMask(bits-5, bits)}
+				args = append(args, "--ip-range", ipRange.String())
+			}
+			if cidr.IP.To4() == nil {
+				ipv6 = true
+			}
+		}
+		if ipv6 {
+			args = append(args, "--ipv6")
 		}
-		m := net.CIDRMask(27, 32)
-		cidr.Mask = m
-		args = append(args, "--ip-range", cidr.String())
 	}
 	args = append(args, name)
 	return exec.Command("docker", args...).Run()
@@ -41,11 +67,41 @@ func DeleteNetwork(name string) error {
 
 // GetContainerHostIfacesIndex returns the interfaces name on the host of the container
 func GetContainerHostIfacesIndex(name string) ([]string, error) {
+	peers, err := containerHostIfaces(name)
+	if err != nil {
+		return nil, err
+	}
+	ifaces := []string{}
+	for _, p := range peers {
+		ifaces = append(ifaces, p[1])
+	}
+	return ifaces, nil
+}
+
+// GetContainerHostIface returns the name on the host of the veth peer
+// of the container interface
+func GetContainerHostIface(name, iface string) (string, error) {
+	peers, err := containerHostIfaces(name)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range peers {
+		if p[0] == iface {
+			return p[1], nil
+		}
+	}
+	return "", fmt.Errorf("veth interface %s not found in container %s", iface, name)
+}
+
+// containerHostIfaces returns the veth interfaces of the container
+// paired with the name of their peers on the host
+func containerHostIfaces(name string) ([][2]string, error) {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
 	ifacesIdx := []int{}
-	ifaces := []string{}
+	containerIfaces := []string{}
+	ifaces := [][2]string{}
 
 	// Save the current network namespace
 	origns, err := netns.Get()
@@ -71,6 +127,7 @@ func GetContainerHostIfacesIndex(name string) ([]string, error) {
 	}
 	links, err := netlink.LinkList()
 	if err != nil {
+		netns.Set(origns)
 		return nil, err
 	}
 	// we need to obtain the peer id
@@ -85,16 +142,17 @@ func GetContainerHostIfacesIndex(name string) ([]string, error) {
 		// I don't know which method is better to get the peer index
 		index, _ := netlink.VethPeerIndex(veth)
 		ifacesIdx = append(ifacesIdx, index)
+		containerIfaces = append(containerIfaces, veth.Attrs().Name)
 	}
 
 	// Switch back to the original namespace to get the interface name
 	netns.Set(origns)
-	for _, idx := range ifacesIdx {
+	for i, idx := range ifacesIdx {
 		ifName, err := netlink.LinkByIndex(idx)
 		if err != nil {
 			return nil, err
 		}
-		ifaces = append(ifaces, ifName.Attrs().Name)
+		ifaces = append(ifaces, [2]string{containerIfaces[i], ifName.Attrs().Name})
 
 	}
 	return ifaces, nil
@@ -106,25 +164,55 @@ func ListNetwork() ([]string, error) {
 	return exec.OutputLines(cmd)
 }
 
-func ConnectNetwork(nameOrId, network, ip string) error {
+// ConnectNetwork connects the container to the network, using the IPv4
+// and IPv6 addresses passed, or letting docker allocate them if empty
+func ConnectNetwork(nameOrId, network string, ips ...string) error {
 	args := []string{"network", "connect"}
-	if ip != "" {
-		args = append(args, "--ip", ip)
+	for _, ip := range ips {
+		if ip == "" {
+			continue
+		}
+		if net.ParseIP(ip).To4() == nil {
+			args = append(args, "--ip6", ip)
+		} else {
+			args = append(args, "--ip", ip)
+		}
 	}
 	args = append(args, network, nameOrId)
 	cmd := exec.Command("docker", args...)
 	return cmd.Run()
 }
 
+// ReplaceGateway replaces the default route of the container, for the
+// IP family of the gateway, to use the gateway passed
 func ReplaceGateway(name, gateway string) error {
 	gw := net.ParseIP(gateway)
-	// TODO: support IPv6
-	if gw.To4() == nil {
-		return fmt.Errorf("unsupported IP %s", gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway IP %s", gateway)
 	}
+	return InContainerNetns(name, func() error {
+		// the route family is obtained from the gateway
+		defaultRoute := &netlink.Route{
+			Dst: nil,
+			Gw:  gw,
+		}
+		return netlink.RouteReplace(defaultRoute)
+	})
+}
+
+// InContainerNetns runs the function in the network namespace of the container
+func InContainerNetns(name string, fn func() error) error {
 	runtime.LockOSThread()
 	defer runtime.UnlockOSThread()
 
+	// Save the current network namespace
+	origns, err := netns.Get()
+	if err != nil {
+		return err
+	}
+	defer origns.Close()
+	defer netns.Set(origns)
+
 	pid, err := getContainerPid(name)
 	if err != nil {
 		return err
@@ -134,16 +222,21 @@ func ReplaceGateway(name, gateway string) error {
 		return err
 	}
 	defer ns.Close()
-	// Swith to the docker namespace to get the container interfaces
+	// Swith to the docker namespace to run the function
 	if err := netns.Set(ns); err != nil {
 		return err
 	}
+	return fn()
+}
 
-	defaultRoute := &netlink.Route{
-		Dst: nil,
-		Gw:  gw,
+// GetContainerNetns returns a handle of the network namespace of the container,
+// the caller has to close it
+func GetContainerNetns(name string) (netns.NsHandle, error) {
+	pid, err := getContainerPid(name)
+	if err != nil {
+		return netns.None(), err
 	}
-	return netlink.RouteReplace(defaultRoute)
+	return netns.GetFromPid(pid)
 }
 
 func getContainerId(name string) (string, error) {
@@ -180,3 +273,51 @@ func GetNetworkInterface(name string) (string, error) {
 	id := lines[0]
 	return "br-" + id[:12], nil
 }
+
+// GetNetworkSubnets returns the subnets configured in the docker network
+func GetNetworkSubnets(name string) ([]string, error) {
+	cmd := exec.Command("docker", "network", "inspect",
+		"--format", `{{ range .IPAM.Config }}{{ .Subnet }}{{ "\n" }}{{ end }}`, name)
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error trying to get network %s subnets", name)
+	}
+	subnets := []string{}
+	for _, l := range lines {
+		if l != "" {
+			subnets = append(subnets, l)
+		}
+	}
+	return subnets, nil
+}
+
+// DisconnectNetwork disconnects the container from the network
+func DisconnectNetwork(nameOrId, network string) error {
+	return exec.Command("docker", "network", "disconnect", network, nameOrId).Run()
+}
+
+// GetContainerMAC returns the MAC address of the container interface on the network
+func GetContainerMAC(name, network string) (string, error) {
+	cmd := exec.Command("docker", "inspect",
+		"--format", fmt.Sprintf(`{{ (index .NetworkSettings.Networks %q).MacAddress }}`, network), name)
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return "", errors.Wrapf(err, "error trying to get container %s MAC address on network %s", name, network)
+	}
+	if len(lines) != 1 || lines[0] == "" {
+		return "", fmt.Errorf("container %s has no MAC address on network %s", name, network)
+	}
+	return lines[0], nil
+}
+
+// GetContainerIPs returns the IPv4 and IPv6 addresses of the container on the
+// network, it returns no addresses if the container is not connected to it
+func GetContainerIPs(name, network string) ([]string, error) {
+	cmd := exec.Command("docker", "inspect",
+		"--format", fmt.Sprintf(`{{ with index .NetworkSettings.Networks %q }}{{ .IPAddress }} {{ .GlobalIPv6Address }}{{ end }}`, network), name)
+	lines, err := exec.OutputLines(cmd)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error trying to get container %s IPs on network %s", name, network)
+	}
+	return strings.Fields(strings.Join(lines, " ")), nil
+}
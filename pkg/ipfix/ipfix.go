@@ -0,0 +1,240 @@
+// Package ipfix implements an IPFIX exporter of flow records, RFC 7011
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	version = 10
+
+	templateSetID        = 2
+	optionsTemplateSetID = 3
+
+	ipv4TemplateID      = 256
+	ipv6TemplateID      = 257
+	interfaceTemplateID = 258
+
+	// reversePEN is the enterprise number of the reverse information elements, RFC 5103
+	reversePEN = 29305
+	// varLength is the field length of the variable length information elements
+	varLength = 0xffff
+)
+
+// fieldSpecifier is an information element of a template
+type fieldSpecifier struct {
+	id         uint16
+	length     uint16
+	enterprise uint32
+}
+
+// information elements, https://www.iana.org/assignments/ipfix
+var (
+	octetDeltaCount          = fieldSpecifier{id: 1, length: 8}
+	packetDeltaCount         = fieldSpecifier{id: 2, length: 8}
+	protocolIdentifier       = fieldSpecifier{id: 4, length: 1}
+	sourceTransportPort      = fieldSpecifier{id: 7, length: 2}
+	sourceIPv4Address        = fieldSpecifier{id: 8, length: 4}
+	ingressInterface         = fieldSpecifier{id: 10, length: 4}
+	destinationTransportPort = fieldSpecifier{id: 11, length: 2}
+	destinationIPv4Address   = fieldSpecifier{id: 12, length: 4}
+	egressInterface          = fieldSpecifier{id: 14, length: 4}
+	sourceIPv6Address        = fieldSpecifier{id: 27, length: 16}
+	destinationIPv6Address   = fieldSpecifier{id: 28, length: 16}
+	interfaceName            = fieldSpecifier{id: 82, length: varLength}
+	interfaceDescription     = fieldSpecifier{id: 83, length: varLength}
+	flowStartMilliseconds    = fieldSpecifier{id: 152, length: 8}
+	flowEndMilliseconds      = fieldSpecifier{id: 153, length: 8}
+
+	reverseOctetDeltaCount  = fieldSpecifier{id: 1, length: 8, enterprise: reversePEN}
+	reversePacketDeltaCount = fieldSpecifier{id: 2, length: 8, enterprise: reversePEN}
+)
+
+// flowFields are the fields of the flow templates after the addresses
+var flowFields = []fieldSpecifier{
+	sourceTransportPort, destinationTransportPort, protocolIdentifier,
+	ingressInterface, egressInterface,
+	octetDeltaCount, packetDeltaCount, reverseOctetDeltaCount, reversePacketDeltaCount,
+	flowStartMilliseconds, flowEndMilliseconds,
+}
+
+// Record is a bidirectional flow record
+type Record struct {
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+	// Ingress and Egress are the indexes of the interfaces the flow
+	// enters and leaves the exporter, described by the Interface records
+	Ingress        uint32
+	Egress         uint32
+	Bytes          uint64
+	Packets        uint64
+	ReverseBytes   uint64
+	ReversePackets uint64
+	Start          time.Time
+	End            time.Time
+}
+
+// Interface describes an interface of the exporter, the description
+// is used to annotate the interface with the network it is connected to
+type Interface struct {
+	Index       uint32
+	Name        string
+	Description string
+}
+
+// Exporter sends IPFIX messages to a collector over UDP
+type Exporter struct {
+	mu   sync.Mutex
+	conn net.Conn
+	// sequences are the number of data records sent per observation domain
+	sequences map[uint32]uint32
+}
+
+// NewExporter returns an exporter to the collector address
+func NewExporter(collector string) (*Exporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{conn: conn, sequences: map[uint32]uint32{}}, nil
+}
+
+// Close closes the connection with the collector
+func (e *Exporter) Close() error {
+	return e.conn.Close()
+}
+
+// Export sends the flow records of the observation domain and the interfaces they
+// reference in one message, the observation domain identifies the observation point
+// in the collector. The templates are sent in every message because the collector
+// may be restarted, and over UDP there is no way to know it.
+func (e *Exporter) Export(domain uint32, records []Record, interfaces []Interface) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var sets bytes.Buffer
+	writeTemplates(&sets)
+
+	count := uint32(0)
+	if len(interfaces) > 0 {
+		var set bytes.Buffer
+		for _, i := range interfaces {
+			binary.Write(&set, binary.BigEndian, i.Index)
+			writeString(&set, i.Name)
+			writeString(&set, i.Description)
+			count++
+		}
+		writeSet(&sets, interfaceTemplateID, set.Bytes())
+	}
+	var ipv4, ipv6 bytes.Buffer
+	for _, r := range records {
+		if r.SrcIP.To4() != nil {
+			ipv4.Write(r.SrcIP.To4())
+			ipv4.Write(r.DstIP.To4())
+			writeFlow(&ipv4, r)
+		} else {
+			ipv6.Write(r.SrcIP.To16())
+			ipv6.Write(r.DstIP.To16())
+			writeFlow(&ipv6, r)
+		}
+		count++
+	}
+	if ipv4.Len() > 0 {
+		writeSet(&sets, ipv4TemplateID, ipv4.Bytes())
+	}
+	if ipv6.Len() > 0 {
+		writeSet(&sets, ipv6TemplateID, ipv6.Bytes())
+	}
+
+	length := 16 + sets.Len()
+	if length > 0xffff {
+		return fmt.Errorf("IPFIX message too long: %d bytes", length)
+	}
+	var msg bytes.Buffer
+	binary.Write(&msg, binary.BigEndian, uint16(version))
+	binary.Write(&msg, binary.BigEndian, uint16(length))
+	binary.Write(&msg, binary.BigEndian, uint32(time.Now().Unix()))
+	binary.Write(&msg, binary.BigEndian, e.sequences[domain])
+	binary.Write(&msg, binary.BigEndian, domain)
+	msg.Write(sets.Bytes())
+	if _, err := e.conn.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	e.sequences[domain] += count
+	return nil
+}
+
+// writeTemplates writes the template set with the IPv4 and IPv6 flow
+// templates and the options template set of the interfaces
+func writeTemplates(w *bytes.Buffer) {
+	var templates bytes.Buffer
+	writeTemplate(&templates, ipv4TemplateID, 0, append([]fieldSpecifier{sourceIPv4Address, destinationIPv4Address}, flowFields...))
+	writeTemplate(&templates, ipv6TemplateID, 0, append([]fieldSpecifier{sourceIPv6Address, destinationIPv6Address}, flowFields...))
+	writeSet(w, templateSetID, templates.Bytes())
+
+	var options bytes.Buffer
+	writeTemplate(&options, interfaceTemplateID, 1, []fieldSpecifier{ingressInterface, interfaceName, interfaceDescription})
+	writeSet(w, optionsTemplateSetID, options.Bytes())
+}
+
+// writeTemplate writes a template record, the options template records
+// have the number of scope fields, that are the first fields
+func writeTemplate(w *bytes.Buffer, id uint16, scope uint16, fields []fieldSpecifier) {
+	binary.Write(w, binary.BigEndian, id)
+	binary.Write(w, binary.BigEndian, uint16(len(fields)))
+	if scope > 0 {
+		binary.Write(w, binary.BigEndian, scope)
+	}
+	for _, f := range fields {
+		if f.enterprise != 0 {
+			binary.Write(w, binary.BigEndian, f.id|0x8000)
+			binary.Write(w, binary.BigEndian, f.length)
+			binary.Write(w, binary.BigEndian, f.enterprise)
+			continue
+		}
+		binary.Write(w, binary.BigEndian, f.id)
+		binary.Write(w, binary.BigEndian, f.length)
+	}
+}
+
+// writeSet writes a set with its header
+func writeSet(w *bytes.Buffer, id uint16, records []byte) {
+	binary.Write(w, binary.BigEndian, id)
+	binary.Write(w, binary.BigEndian, uint16(4+len(records)))
+	w.Write(records)
+}
+
+// writeFlow writes the fields of the flow record after the addresses
+func writeFlow(w *bytes.Buffer, r Record) {
+	binary.Write(w, binary.BigEndian, r.SrcPort)
+	binary.Write(w, binary.BigEndian, r.DstPort)
+	w.WriteByte(r.Protocol)
+	binary.Write(w, binary.BigEndian, r.Ingress)
+	binary.Write(w, binary.BigEndian, r.Egress)
+	binary.Write(w, binary.BigEndian, r.Bytes)
+	binary.Write(w, binary.BigEndian, r.Packets)
+	binary.Write(w, binary.BigEndian, r.ReverseBytes)
+	binary.Write(w, binary.BigEndian, r.ReversePackets)
+	binary.Write(w, binary.BigEndian, uint64(r.Start.UnixNano()/int64(time.Millisecond)))
+	binary.Write(w, binary.BigEndian, uint64(r.End.UnixNano()/int64(time.Millisecond)))
+}
+
+// writeString writes a variable length string, the length is encoded
+// in one byte, or in three bytes if it is 255 or longer
+func writeString(w *bytes.Buffer, s string) {
+	if len(s) < 255 {
+		w.WriteByte(byte(len(s)))
+	} else {
+		w.WriteByte(255)
+		binary.Write(w, binary.BigEndian, uint16(len(s)))
+	}
+	w.WriteString(s)
+}
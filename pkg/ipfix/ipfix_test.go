@@ -0,0 +1,147 @@
+package ipfix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportGolden is the message exported for the observation domain 7 with two
+// interfaces, an IPv4 flow and an IPv6 flow, the export time is zeroed
+const exportGolden = "" +
+	// message header: version 10, length 384, export time, sequence 0, domain 7
+	"000a0180000000000000000000000007" +
+	// template set
+	"00020084" +
+	// ipv4 template 256 with 13 fields, the reverse counters with the enterprise number 29305
+	"0100000d00080004000c000400070002" +
+	"000b000200040001000a0004000e0004" +
+	"00010008000200088001000800007279" +
+	"80020008000072790098000800990008" +
+	// ipv6 template 257 with 13 fields
+	"0101000d001b0010001c001000070002" +
+	"000b000200040001000a0004000e0004" +
+	"00010008000200088001000800007279" +
+	"80020008000072790098000800990008" +
+	// options template set, template 258 with 3 fields and 1 scope field,
+	// the interface name and description are variable length
+	"00030016010200030001000a00040052" +
+	"ffff0053ffff" +
+	// interfaces data set: 2 eth1 cluster-eu, 3 eth2 cluster-us
+	"0102002c0000000204657468310a636c" +
+	"75737465722d65750000000304657468" +
+	"320a636c75737465722d7573" +
+	// ipv4 data set: 10.0.1.5:43210 -> 10.0.2.6:443 tcp, 2 -> 3,
+	// 1874 bytes 12 packets, 5321 reverse bytes 10 reverse packets, start, end
+	"010000490a0001050a000206a8ca01bb" +
+	"06000000020000000300000000000007" +
+	"52000000000000000c00000000000014" +
+	"c9000000000000000a00000179c70405" +
+	"6400000179c7040dfc" +
+	// ipv6 data set: [fd00::1]:5353 -> [fd00::2]:53 udp, 3 -> 2,
+	// 100 bytes 1 packet, 200 reverse bytes 2 reverse packets, start, end
+	"01010061fd0000000000000000000000" +
+	"00000001fd0000000000000000000000" +
+	"0000000214e900351100000003000000" +
+	"02000000000000006400000000000000" +
+	"0100000000000000c800000000000000" +
+	"0200000179c704056400000179c7040d" +
+	"fc"
+
+func TestExport(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	e, err := NewExporter(collector.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	start := time.Unix(0, 1622541600100*int64(time.Millisecond))
+	end := time.Unix(0, 1622541602300*int64(time.Millisecond))
+	records := []Record{
+		{
+			SrcIP: net.ParseIP("10.0.1.5"), DstIP: net.ParseIP("10.0.2.6"),
+			SrcPort: 43210, DstPort: 443, Protocol: 6,
+			Ingress: 2, Egress: 3,
+			Bytes: 1874, Packets: 12, ReverseBytes: 5321, ReversePackets: 10,
+			Start: start, End: end,
+		},
+		{
+			SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2"),
+			SrcPort: 5353, DstPort: 53, Protocol: 17,
+			Ingress: 3, Egress: 2,
+			Bytes: 100, Packets: 1, ReverseBytes: 200, ReversePackets: 2,
+			Start: start, End: end,
+		},
+	}
+	interfaces := []Interface{
+		{Index: 2, Name: "eth1", Description: "cluster-eu"},
+		{Index: 3, Name: "eth2", Description: "cluster-us"},
+	}
+	want, err := hex.DecodeString(exportGolden)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 65535)
+	for i, sequence := range []uint32{0, 4} {
+		before := time.Now().Unix()
+		if err := e.Export(7, records, interfaces); err != nil {
+			t.Fatal(err)
+		}
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := buf[:n]
+		if len(got) != len(want) {
+			t.Fatalf("message %d: expected %d bytes, got %d", i, len(want), len(got))
+		}
+		exportTime := int64(binary.BigEndian.Uint32(got[4:8]))
+		if exportTime < before || exportTime > time.Now().Unix() {
+			t.Errorf("message %d: unexpected export time %d", i, exportTime)
+		}
+		// the sequence is the number of data records sent before the message
+		if s := binary.BigEndian.Uint32(got[8:12]); s != sequence {
+			t.Errorf("message %d: expected sequence %d, got %d", i, sequence, s)
+		}
+		copy(got[4:12], make([]byte, 8))
+		if !bytes.Equal(got, want) {
+			t.Errorf("message %d:\nexpected %x\ngot      %x", i, want, got)
+		}
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		name   string
+		s      string
+		header string
+	}{
+		{name: "empty", s: "", header: "00"},
+		{name: "short", s: "eth1", header: "04"},
+		{name: "254 bytes", s: long[:254], header: "fe"},
+		{name: "255 bytes", s: long[:255], header: "ff00ff"},
+		{name: "300 bytes", s: long, header: "ff012c"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			writeString(&b, tt.s)
+			want := tt.header + hex.EncodeToString([]byte(tt.s))
+			if got := hex.EncodeToString(b.Bytes()); got != want {
+				t.Errorf("expected %s, got %s", want, got)
+			}
+		})
+	}
+}
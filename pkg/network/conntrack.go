@@ -0,0 +1,176 @@
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// ConntrackFlow is a connection tracked by conntrack, with the counters and
+// timestamps if the accounting and timestamping of conntrack are enabled
+type ConntrackFlow struct {
+	Family   uint8
+	Protocol uint8
+	SrcIP    net.IP
+	DstIP    net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	// Bytes and Packets are the counters of the original direction
+	Bytes   uint64
+	Packets uint64
+	// ReplyBytes and ReplyPackets are the counters of the reply direction
+	ReplyBytes   uint64
+	ReplyPackets uint64
+	Start        time.Time
+	Stop         time.Time
+}
+
+// ConntrackEvents is a subscription to the conntrack events of a netns
+type ConntrackEvents struct {
+	socket *nl.NetlinkSocket
+}
+
+// SubscribeConntrackDestroy subscribes to the events of the connections destroyed
+// in the current netns, the socket keeps receiving the events of the netns after
+// the thread leaves it.
+func SubscribeConntrackDestroy() (*ConntrackEvents, error) {
+	socket, err := nl.Subscribe(unix.NETLINK_NETFILTER, unix.NFNLGRP_CONNTRACK_DESTROY)
+	if err != nil {
+		return nil, err
+	}
+	return &ConntrackEvents{socket: socket}, nil
+}
+
+// Close closes the subscription, unblocking Receive
+func (e *ConntrackEvents) Close() {
+	e.socket.Close()
+}
+
+// Receive blocks until there are conntrack events and returns the flows
+func (e *ConntrackEvents) Receive() ([]ConntrackFlow, error) {
+	msgs, _, err := e.socket.Receive()
+	if err != nil {
+		return nil, err
+	}
+	flows := []ConntrackFlow{}
+	for _, m := range msgs {
+		if m.Header.Type != unix.NFNL_SUBSYS_CTNETLINK<<8|nl.IPCTNL_MSG_CT_DELETE {
+			continue
+		}
+		flow, err := parseConntrackFlow(m.Data)
+		if err != nil {
+			return nil, err
+		}
+		flows = append(flows, *flow)
+	}
+	return flows, nil
+}
+
+// parseConntrackFlow parses a ctnetlink message, the struct nfgenmsg followed
+// by the conntrack attributes. The library parser expects a fixed layout of the
+// attributes and does not parse the timestamps, so the attributes are walked.
+func parseConntrackFlow(data []byte) (*ConntrackFlow, error) {
+	if len(data) < nl.SizeofNfgenmsg {
+		return nil, fmt.Errorf("conntrack message too short")
+	}
+	flow := &ConntrackFlow{Family: data[0]}
+	attrs, err := nfAttrs(data[nl.SizeofNfgenmsg:])
+	if err != nil {
+		return nil, err
+	}
+	for typ, value := range attrs {
+		switch typ {
+		case nl.CTA_TUPLE_ORIG:
+			if err := parseConntrackTuple(value, flow); err != nil {
+				return nil, err
+			}
+		case nl.CTA_COUNTERS_ORIG:
+			flow.Packets, flow.Bytes, err = parseConntrackCounters(value)
+		case nl.CTA_COUNTERS_REPLY:
+			flow.ReplyPackets, flow.ReplyBytes, err = parseConntrackCounters(value)
+		case nl.CTA_TIMESTAMP:
+			flow.Start, flow.Stop, err = parseConntrackTimestamp(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return flow, nil
+}
+
+func parseConntrackTuple(data []byte, flow *ConntrackFlow) error {
+	attrs, err := nfAttrs(data)
+	if err != nil {
+		return err
+	}
+	ips, err := nfAttrs(attrs[nl.CTA_TUPLE_IP])
+	if err != nil {
+		return err
+	}
+	for typ, value := range ips {
+		switch typ {
+		case nl.CTA_IP_V4_SRC, nl.CTA_IP_V6_SRC:
+			flow.SrcIP = net.IP(value)
+		case nl.CTA_IP_V4_DST, nl.CTA_IP_V6_DST:
+			flow.DstIP = net.IP(value)
+		}
+	}
+	proto, err := nfAttrs(attrs[nl.CTA_TUPLE_PROTO])
+	if err != nil {
+		return err
+	}
+	for typ, value := range proto {
+		switch {
+		case typ == nl.CTA_PROTO_NUM && len(value) >= 1:
+			flow.Protocol = value[0]
+		case typ == nl.CTA_PROTO_SRC_PORT && len(value) >= 2:
+			flow.SrcPort = binary.BigEndian.Uint16(value)
+		case typ == nl.CTA_PROTO_DST_PORT && len(value) >= 2:
+			flow.DstPort = binary.BigEndian.Uint16(value)
+		}
+	}
+	return nil
+}
+
+func parseConntrackCounters(data []byte) (uint64, uint64, error) {
+	attrs, err := nfAttrs(data)
+	if err != nil {
+		return 0, 0, err
+	}
+	return nfUint64(attrs[nl.CTA_COUNTERS_PACKETS]), nfUint64(attrs[nl.CTA_COUNTERS_BYTES]), nil
+}
+
+func parseConntrackTimestamp(data []byte) (time.Time, time.Time, error) {
+	attrs, err := nfAttrs(data)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	start := time.Unix(0, int64(nfUint64(attrs[nl.CTA_TIMESTAMP_START])))
+	stop := time.Unix(0, int64(nfUint64(attrs[nl.CTA_TIMESTAMP_STOP])))
+	return start, stop, nil
+}
+
+// nfAttrs returns the netfilter attributes by type, without the nested and byte order flags
+func nfAttrs(data []byte) (map[uint16][]byte, error) {
+	attrs, err := nl.ParseRouteAttr(data)
+	if err != nil {
+		return nil, err
+	}
+	m := map[uint16][]byte{}
+	for _, attr := range attrs {
+		m[attr.Attr.Type&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER)] = attr.Value
+	}
+	return m, nil
+}
+
+// nfUint64 returns the value of a 64 bits attribute, in network byte order
+func nfUint64(value []byte) uint64 {
+	if len(value) < 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
@@ -0,0 +1,151 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// conntrackDestroyMsg is the payload of a IPCTNL_MSG_CT_DELETE message of a TCP
+// connection from 10.0.1.5:43210 to 10.0.2.6:443, with the accounting and the
+// timestamps of conntrack enabled. The attribute headers are in host byte order,
+// little endian, and the values in network byte order.
+var conntrackDestroyMsg = []byte{
+	// struct nfgenmsg: AF_INET, version, res_id
+	0x02, 0x00, 0x00, 0x00,
+	// CTA_TUPLE_ORIG | NLA_F_NESTED
+	0x34, 0x00, 0x01, 0x80,
+	// CTA_TUPLE_IP | NLA_F_NESTED
+	0x14, 0x00, 0x01, 0x80,
+	// CTA_IP_V4_SRC 10.0.1.5
+	0x08, 0x00, 0x01, 0x00,
+	0x0a, 0x00, 0x01, 0x05,
+	// CTA_IP_V4_DST 10.0.2.6
+	0x08, 0x00, 0x02, 0x00,
+	0x0a, 0x00, 0x02, 0x06,
+	// CTA_TUPLE_PROTO | NLA_F_NESTED
+	0x1c, 0x00, 0x02, 0x80,
+	// CTA_PROTO_NUM tcp
+	0x05, 0x00, 0x01, 0x00,
+	0x06, 0x00, 0x00, 0x00,
+	// CTA_PROTO_SRC_PORT 43210
+	0x06, 0x00, 0x02, 0x00,
+	0xa8, 0xca, 0x00, 0x00,
+	// CTA_PROTO_DST_PORT 443
+	0x06, 0x00, 0x03, 0x00,
+	0x01, 0xbb, 0x00, 0x00,
+	// CTA_TUPLE_REPLY | NLA_F_NESTED, it is ignored
+	0x34, 0x00, 0x02, 0x80,
+	0x14, 0x00, 0x01, 0x80,
+	0x08, 0x00, 0x01, 0x00,
+	0x0a, 0x00, 0x02, 0x06,
+	0x08, 0x00, 0x02, 0x00,
+	0x0a, 0x00, 0x01, 0x05,
+	0x1c, 0x00, 0x02, 0x80,
+	0x05, 0x00, 0x01, 0x00,
+	0x06, 0x00, 0x00, 0x00,
+	0x06, 0x00, 0x02, 0x00,
+	0x01, 0xbb, 0x00, 0x00,
+	0x06, 0x00, 0x03, 0x00,
+	0xa8, 0xca, 0x00, 0x00,
+	// CTA_COUNTERS_ORIG | NLA_F_NESTED
+	0x1c, 0x00, 0x09, 0x80,
+	// CTA_COUNTERS_PACKETS 12
+	0x0c, 0x00, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0c,
+	// CTA_COUNTERS_BYTES 1874
+	0x0c, 0x00, 0x02, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x52,
+	// CTA_COUNTERS_REPLY | NLA_F_NESTED
+	0x1c, 0x00, 0x0a, 0x80,
+	// CTA_COUNTERS_PACKETS 10
+	0x0c, 0x00, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a,
+	// CTA_COUNTERS_BYTES 5321
+	0x0c, 0x00, 0x02, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x14, 0xc9,
+	// CTA_TIMESTAMP | NLA_F_NESTED
+	0x1c, 0x00, 0x14, 0x80,
+	// CTA_TIMESTAMP_START 1622541600100000000ns
+	0x0c, 0x00, 0x01, 0x00,
+	0x16, 0x84, 0x6c, 0xfd, 0x1b, 0x41, 0x21, 0x00,
+	// CTA_TIMESTAMP_STOP 1622541602300000000ns
+	0x0c, 0x00, 0x02, 0x00,
+	0x16, 0x84, 0x6c, 0xfd, 0x9e, 0x62, 0x77, 0x00,
+}
+
+func TestParseConntrackFlow(t *testing.T) {
+	skipBigEndian(t)
+	flow, err := parseConntrackFlow(conntrackDestroyMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ConntrackFlow{
+		Family:       2,
+		Protocol:     6,
+		SrcIP:        net.IPv4(10, 0, 1, 5).To4(),
+		DstIP:        net.IPv4(10, 0, 2, 6).To4(),
+		SrcPort:      43210,
+		DstPort:      443,
+		Bytes:        1874,
+		Packets:      12,
+		ReplyBytes:   5321,
+		ReplyPackets: 10,
+		Start:        time.Unix(0, 1622541600100000000),
+		Stop:         time.Unix(0, 1622541602300000000),
+	}
+	if !flow.SrcIP.Equal(want.SrcIP) || !flow.DstIP.Equal(want.DstIP) {
+		t.Errorf("expected %s -> %s, got %s -> %s", want.SrcIP, want.DstIP, flow.SrcIP, flow.DstIP)
+	}
+	flow.SrcIP, flow.DstIP = want.SrcIP, want.DstIP
+	if flow.Family != want.Family || flow.Protocol != want.Protocol ||
+		flow.SrcPort != want.SrcPort || flow.DstPort != want.DstPort ||
+		flow.Bytes != want.Bytes || flow.Packets != want.Packets ||
+		flow.ReplyBytes != want.ReplyBytes || flow.ReplyPackets != want.ReplyPackets ||
+		!flow.Start.Equal(want.Start) || !flow.Stop.Equal(want.Stop) {
+		t.Errorf("expected %+v, got %+v", want, *flow)
+	}
+}
+
+func TestParseConntrackFlowIPv6(t *testing.T) {
+	skipBigEndian(t)
+	msg := []byte{
+		// struct nfgenmsg: AF_INET6, version, res_id
+		0x0a, 0x00, 0x00, 0x00,
+		// CTA_TUPLE_ORIG | NLA_F_NESTED
+		0x3c, 0x00, 0x01, 0x80,
+		// CTA_TUPLE_IP | NLA_F_NESTED
+		0x2c, 0x00, 0x01, 0x80,
+		// CTA_IP_V6_SRC fd00::1
+		0x14, 0x00, 0x03, 0x00,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		// CTA_IP_V6_DST fd00::2
+		0x14, 0x00, 0x04, 0x00,
+		0xfd, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02,
+		// CTA_TUPLE_PROTO | NLA_F_NESTED
+		0x0c, 0x00, 0x02, 0x80,
+		// CTA_PROTO_NUM udp
+		0x05, 0x00, 0x01, 0x00,
+		0x11, 0x00, 0x00, 0x00,
+	}
+	flow, err := parseConntrackFlow(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow.Family != 10 || flow.Protocol != 17 ||
+		!flow.SrcIP.Equal(net.ParseIP("fd00::1")) || !flow.DstIP.Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("unexpected flow %+v", *flow)
+	}
+	// without accounting and timestamps the counters are zero
+	if flow.Bytes != 0 || flow.ReplyBytes != 0 || !flow.Start.IsZero() {
+		t.Errorf("unexpected counters %+v", *flow)
+	}
+}
+
+func TestParseConntrackFlowShort(t *testing.T) {
+	if _, err := parseConntrackFlow([]byte{0x02, 0x00}); err == nil {
+		t.Error("expected error for a message shorter than nfgenmsg")
+	}
+}
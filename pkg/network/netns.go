@@ -0,0 +1,45 @@
+package network
+
+import (
+	"context"
+	"net"
+	"runtime"
+
+	"github.com/vishvananda/netns"
+)
+
+// DialInNetns opens a connection from the network namespace, the host name
+// of the address is resolved in the current namespace because the resolvers
+// of the host may not be reachable from the namespace
+func DialInNetns(ctx context.Context, ns netns.NsHandle, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	origns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer origns.Close()
+	if err := netns.Set(ns); err != nil {
+		return nil, err
+	}
+	defer netns.Set(origns)
+
+	var d net.Dialer
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
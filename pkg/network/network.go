@@ -1,6 +1,8 @@
 package network
 
 import (
+	"fmt"
+	"math/big"
 	"net"
 
 	"github.com/vishvananda/netlink"
@@ -22,6 +24,50 @@ func CreateVeth(name1, name2 string) error {
 
 }
 
+// CreateVxlan creates a point to point VXLAN interface to the remote address
+// and sets it up, the MAC address of the interface is random if not set
+func CreateVxlan(name string, vni int, local, remote net.IP, port, mtu int, mac net.HardwareAddr) error {
+	vxlan := &netlink.Vxlan{
+		LinkAttrs: netlink.LinkAttrs{
+			Name:         name,
+			MTU:          mtu,
+			HardwareAddr: mac,
+		},
+		VxlanId: vni,
+		SrcAddr: local,
+		// an unicast group is the remote endpoint of the tunnel
+		Group: remote,
+		Port:  port,
+	}
+	if err := netlink.LinkAdd(vxlan); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(vxlan)
+}
+
+// CreateGre creates a point to point GRE interface to the remote address
+// and sets it up, the tunnel is ip6gre if the addresses are IPv6
+func CreateGre(name string, local, remote net.IP, mtu int) error {
+	gre := &netlink.Gretun{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+		},
+		Local:  local,
+		Remote: remote,
+	}
+	if err := netlink.LinkAdd(gre); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(gre)
+}
+
+// InterfaceExists returns true if the interface exists
+func InterfaceExists(name string) bool {
+	_, err := netlink.LinkByName(name)
+	return err == nil
+}
+
 func AddInterfaceBridge(ifaz, bridge string) error {
 	ifLink, err := netlink.LinkByName(ifaz)
 	if err != nil {
@@ -42,6 +88,22 @@ func DeleteInterface(name string) error {
 	return netlink.LinkDel(link)
 }
 
+// ReplaceRoute adds or replaces the route to the subnet through the gateway
+func ReplaceRoute(subnet, gateway string) error {
+	_, dst, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway IP %s", gateway)
+	}
+	return netlink.RouteReplace(&netlink.Route{
+		Dst: dst,
+		Gw:  gw,
+	})
+}
+
 // GetLastIPSubnet obtains the last IP in the range
 func GetLastIPSubnet(cidr string) (net.IP, error) {
 	_, ipnet, err := net.ParseCIDR(cidr)
@@ -61,3 +123,27 @@ func GetLastIPSubnet(cidr string) (net.IP, error) {
 
 	return lastIP, nil
 }
+
+// IsIPv6CIDR returns true if the cidr is an IPv6 subnet
+func IsIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// AddIPOffset returns the IP address resulting of adding the offset,
+// that can be negative, to the IP address passed
+func AddIPOffset(ip net.IP, offset int) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n := new(big.Int).SetBytes(ip)
+	n.Add(n, big.NewInt(int64(offset)))
+	b := n.Bytes()
+	// keep the length of the original IP address
+	result := make(net.IP, len(ip))
+	if len(b) > len(result) {
+		b = b[len(b)-len(result):]
+	}
+	copy(result[len(result)-len(b):], b)
+	return result
+}
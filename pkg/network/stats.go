@@ -0,0 +1,187 @@
+package network
+
+import (
+	"math"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// netem attributes not defined by the netlink library, include/uapi/linux/pkt_sched.h
+const (
+	tcaNetemLatency64 = 10
+	tcaNetemJitter64  = 11
+)
+
+// InterfaceStats are the counters of a network interface
+type InterfaceStats struct {
+	Name         string
+	Index        int
+	HardwareAddr net.HardwareAddr
+	RxBytes      uint64
+	TxBytes      uint64
+	RxPackets    uint64
+	TxPackets    uint64
+	RxDropped    uint64
+	TxDropped    uint64
+}
+
+// QdiscStats are the counters of a qdisc, and the emulation
+// parameters if it is a netem qdisc
+type QdiscStats struct {
+	Kind       string
+	LinkIndex  int
+	Handle     uint32
+	Parent     uint32
+	Bytes      uint64
+	Packets    uint32
+	Drops      uint32
+	Overlimits uint32
+	Requeues   uint32
+	Backlog    uint32
+	Qlen       uint32
+	Netem      *NetemParameters
+}
+
+// NetemParameters are the network emulation parameters of a netem qdisc
+type NetemParameters struct {
+	Delay  time.Duration
+	Jitter time.Duration
+	// Loss is the percentage of packets dropped
+	Loss  float64
+	Limit uint32
+}
+
+// ListInterfaceStats returns the counters of the interfaces in the current netns
+func ListInterfaceStats() ([]InterfaceStats, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, err
+	}
+	stats := []InterfaceStats{}
+	for _, l := range links {
+		attrs := l.Attrs()
+		s := InterfaceStats{Name: attrs.Name, Index: attrs.Index, HardwareAddr: attrs.HardwareAddr}
+		if attrs.Statistics != nil {
+			s.RxBytes = attrs.Statistics.RxBytes
+			s.TxBytes = attrs.Statistics.TxBytes
+			s.RxPackets = attrs.Statistics.RxPackets
+			s.TxPackets = attrs.Statistics.TxPackets
+			s.RxDropped = attrs.Statistics.RxDropped
+			s.TxDropped = attrs.Statistics.TxDropped
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// ListQdiscStats returns the counters of all the qdiscs in the current netns,
+// the netlink library does not parse the statistics of the qdiscs so they
+// are dumped directly.
+func ListQdiscStats() ([]QdiscStats, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETQDISC, unix.NLM_F_DUMP)
+	req.AddData(&nl.TcMsg{Family: nl.FAMILY_ALL})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWQDISC)
+	if err != nil {
+		return nil, err
+	}
+	stats := []QdiscStats{}
+	for _, m := range msgs {
+		s, err := parseQdiscStats(m)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// parseQdiscStats parses a RTM_NEWQDISC message, the struct tcmsg
+// followed by the qdisc attributes
+func parseQdiscStats(m []byte) (QdiscStats, error) {
+	native := nl.NativeEndian()
+	msg := nl.DeserializeTcMsg(m)
+	attrs, err := nl.ParseRouteAttr(m[msg.Len():])
+	if err != nil {
+		return QdiscStats{}, err
+	}
+	s := QdiscStats{
+		LinkIndex: int(msg.Ifindex),
+		Handle:    msg.Handle,
+		Parent:    msg.Parent,
+	}
+	var options []byte
+	for _, attr := range attrs {
+		switch attr.Attr.Type {
+		case nl.TCA_KIND:
+			s.Kind = string(attr.Value[:len(attr.Value)-1])
+		case nl.TCA_OPTIONS:
+			options = attr.Value
+		case nl.TCA_STATS2:
+			stats2, err := nl.ParseRouteAttr(attr.Value)
+			if err != nil {
+				return QdiscStats{}, err
+			}
+			for _, stat := range stats2 {
+				switch stat.Attr.Type {
+				// struct gnet_stats_basic
+				case nl.TCA_STATS_BASIC:
+					if len(stat.Value) >= 12 {
+						s.Bytes = native.Uint64(stat.Value[0:8])
+						s.Packets = native.Uint32(stat.Value[8:12])
+					}
+				// struct gnet_stats_queue
+				case nl.TCA_STATS_QUEUE:
+					if len(stat.Value) >= 20 {
+						s.Qlen = native.Uint32(stat.Value[0:4])
+						s.Backlog = native.Uint32(stat.Value[4:8])
+						s.Drops = native.Uint32(stat.Value[8:12])
+						s.Requeues = native.Uint32(stat.Value[12:16])
+						s.Overlimits = native.Uint32(stat.Value[16:20])
+					}
+				}
+			}
+		}
+	}
+	if s.Kind == "netem" && len(options) >= nl.SizeofTcNetemQopt {
+		s.Netem, err = parseNetemParameters(options)
+		if err != nil {
+			return QdiscStats{}, err
+		}
+	}
+	return s, nil
+}
+
+// parseNetemParameters parses the options of a netem qdisc, the struct
+// tc_netem_qopt followed by the netem attributes
+func parseNetemParameters(options []byte) (*NetemParameters, error) {
+	opt := nl.DeserializeTcNetemQopt(options)
+	p := &NetemParameters{
+		// the latency and jitter of the struct are in scheduler ticks of 64ns,
+		// the 64 bits attributes in nanoseconds are preferred if present
+		Delay:  time.Duration(opt.Latency) * 64,
+		Jitter: time.Duration(opt.Jitter) * 64,
+		Loss:   float64(opt.Loss) / math.MaxUint32 * 100,
+		Limit:  opt.Limit,
+	}
+	attrs, err := nl.ParseRouteAttr(options[nl.SizeofTcNetemQopt:])
+	if err != nil {
+		return nil, err
+	}
+	native := nl.NativeEndian()
+	for _, attr := range attrs {
+		if len(attr.Value) < 8 {
+			continue
+		}
+		switch attr.Attr.Type {
+		case tcaNetemLatency64:
+			p.Delay = time.Duration(native.Uint64(attr.Value))
+		case tcaNetemJitter64:
+			p.Jitter = time.Duration(native.Uint64(attr.Value))
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+)
+
+// the golden messages are in little endian, the netlink byte order of the test hosts
+func skipBigEndian(t *testing.T) {
+	if nl.NativeEndian() != binary.LittleEndian {
+		t.Skip("golden bytes are little endian")
+	}
+}
+
+// netemQdiscMsg is a RTM_NEWQDISC message of a netem qdisc with 100ms of
+// delay, 10ms of jitter and 1% of loss, as dumped by the kernel
+var netemQdiscMsg = []byte{
+	// struct tcmsg: family, pad, ifindex 3, handle 9:, parent 1:9, info
+	0x00, 0x00, 0x00, 0x00,
+	0x03, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x09, 0x00,
+	0x09, 0x00, 0x01, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	// TCA_KIND "netem\0" padded to 4 bytes
+	0x0a, 0x00, 0x01, 0x00,
+	'n', 'e', 't', 'e', 'm', 0x00, 0x00, 0x00,
+	// TCA_OPTIONS
+	0x28, 0x00, 0x02, 0x00,
+	// struct tc_netem_qopt: latency 1562500 ticks, limit 1000, loss 1%,
+	// gap, duplicate, jitter 156250 ticks
+	0x84, 0xd7, 0x17, 0x00,
+	0xe8, 0x03, 0x00, 0x00,
+	0x29, 0x5c, 0x8f, 0x02,
+	0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x5a, 0x62, 0x02, 0x00,
+	// TCA_NETEM_LATENCY64 100000050ns
+	0x0c, 0x00, 0x0a, 0x00,
+	0x32, 0xe1, 0xf5, 0x05, 0x00, 0x00, 0x00, 0x00,
+	// TCA_STATS2
+	0x30, 0x00, 0x07, 0x00,
+	// TCA_STATS_BASIC, struct gnet_stats_basic: bytes 1500, packets 10, padding
+	0x14, 0x00, 0x01, 0x00,
+	0xdc, 0x05, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x0a, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	// TCA_STATS_QUEUE, struct gnet_stats_queue: qlen 1, backlog 100,
+	// drops 2, requeues 0, overlimits 3
+	0x18, 0x00, 0x03, 0x00,
+	0x01, 0x00, 0x00, 0x00,
+	0x64, 0x00, 0x00, 0x00,
+	0x02, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00,
+	0x03, 0x00, 0x00, 0x00,
+}
+
+func TestParseQdiscStats(t *testing.T) {
+	skipBigEndian(t)
+	s, err := parseQdiscStats(netemQdiscMsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Kind != "netem" || s.LinkIndex != 3 || s.Handle != 0x90000 || s.Parent != 0x10009 {
+		t.Errorf("unexpected qdisc %s link %d handle %x parent %x", s.Kind, s.LinkIndex, s.Handle, s.Parent)
+	}
+	if s.Bytes != 1500 || s.Packets != 10 {
+		t.Errorf("unexpected basic stats bytes %d packets %d", s.Bytes, s.Packets)
+	}
+	if s.Qlen != 1 || s.Backlog != 100 || s.Drops != 2 || s.Requeues != 0 || s.Overlimits != 3 {
+		t.Errorf("unexpected queue stats %+v", s)
+	}
+	if s.Netem == nil {
+		t.Fatal("netem parameters not parsed")
+	}
+	// the 64 bits latency takes precedence over the ticks
+	if s.Netem.Delay != 100000050*time.Nanosecond {
+		t.Errorf("expected delay 100000050ns, got %v", s.Netem.Delay)
+	}
+	if s.Netem.Jitter != 10*time.Millisecond {
+		t.Errorf("expected jitter 10ms, got %v", s.Netem.Jitter)
+	}
+	if math.Abs(s.Netem.Loss-1) > 1e-6 {
+		t.Errorf("expected loss 1%%, got %v", s.Netem.Loss)
+	}
+	if s.Netem.Limit != 1000 {
+		t.Errorf("expected limit 1000, got %d", s.Netem.Limit)
+	}
+}
+
+func TestParseQdiscStatsNotNetem(t *testing.T) {
+	skipBigEndian(t)
+	msg := []byte{
+		// struct tcmsg: ifindex 2, handle 1:, parent root
+		0x00, 0x00, 0x00, 0x00,
+		0x02, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x01, 0x00,
+		0xff, 0xff, 0xff, 0xff,
+		0x00, 0x00, 0x00, 0x00,
+		// TCA_KIND "htb\0"
+		0x08, 0x00, 0x01, 0x00,
+		'h', 't', 'b', 0x00,
+	}
+	s, err := parseQdiscStats(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Kind != "htb" || s.LinkIndex != 2 || s.Parent != 0xffffffff || s.Netem != nil {
+		t.Errorf("unexpected qdisc %+v", s)
+	}
+}
+
+func TestParseNetemParameters(t *testing.T) {
+	skipBigEndian(t)
+	tests := []struct {
+		name    string
+		options []byte
+		want    NetemParameters
+	}{
+		{
+			name: "ticks",
+			// struct tc_netem_qopt: latency 781250 ticks, limit 1000, loss 0,
+			// gap, duplicate, jitter 0
+			options: []byte{
+				0xc2, 0xeb, 0x0b, 0x00,
+				0xe8, 0x03, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+			},
+			want: NetemParameters{Delay: 50 * time.Millisecond, Limit: 1000},
+		},
+		{
+			name: "64 bits attributes",
+			// struct tc_netem_qopt: latency and jitter of 1 tick, limit 16,
+			// loss 100%, the ticks overridden by the 64 bits attributes
+			options: []byte{
+				0x01, 0x00, 0x00, 0x00,
+				0x10, 0x00, 0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff,
+				0x00, 0x00, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00,
+				0x01, 0x00, 0x00, 0x00,
+				// TCA_NETEM_LATENCY64 2s
+				0x0c, 0x00, 0x0a, 0x00,
+				0x00, 0x94, 0x35, 0x77, 0x00, 0x00, 0x00, 0x00,
+				// TCA_NETEM_JITTER64 1ms
+				0x0c, 0x00, 0x0b, 0x00,
+				0x40, 0x42, 0x0f, 0x00, 0x00, 0x00, 0x00, 0x00,
+			},
+			want: NetemParameters{Delay: 2 * time.Second, Jitter: time.Millisecond, Loss: 100, Limit: 16},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNetemParameters(tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != tt.want {
+				t.Errorf("expected %+v, got %+v", tt.want, *got)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/sys/unix"
+)
+
+// WireGuard generic netlink API, include/uapi/linux/wireguard.h
+const (
+	wgGenlName     = "wireguard"
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname     = 2
+	wgDeviceAPrivateKey = 3
+	wgDeviceAFlags      = 5
+	wgDeviceAListenPort = 6
+	wgDeviceAPeers      = 8
+
+	wgDeviceFReplacePeers = 1
+
+	wgPeerAPublicKey                   = 1
+	wgPeerAFlags                       = 3
+	wgPeerAEndpoint                    = 4
+	wgPeerAPersistentKeepaliveInterval = 5
+	wgPeerAAllowedIPs                  = 9
+
+	wgPeerFReplaceAllowedIPs = 2
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+// WireguardKey is a curve25519 key of a WireGuard interface
+type WireguardKey [32]byte
+
+// String returns the key base64 encoded, as the wg tool does
+func (k WireguardKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// ParseWireguardKey parses a base64 encoded key
+func ParseWireguardKey(s string) (WireguardKey, error) {
+	var key WireguardKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("invalid key length %d", len(b))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// GenerateWireguardKeys returns a new private key and its public key
+func GenerateWireguardKeys() (WireguardKey, WireguardKey, error) {
+	var private, public WireguardKey
+	if _, err := rand.Read(private[:]); err != nil {
+		return private, public, err
+	}
+	// clamp the private key as described in the curve25519 paper
+	private[0] &= 248
+	private[31] = (private[31] & 127) | 64
+	b, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return private, public, err
+	}
+	copy(public[:], b)
+	return private, public, nil
+}
+
+// WireguardPeer is a peer of a WireGuard interface
+type WireguardPeer struct {
+	PublicKey WireguardKey
+	Endpoint  *net.UDPAddr
+	// AllowedIPs are the subnets routed to the peer
+	AllowedIPs []*net.IPNet
+	// PersistentKeepalive interval in seconds, 0 disables it
+	PersistentKeepalive uint16
+}
+
+// WireguardConfig is the configuration of a WireGuard interface,
+// the private key and listen port are not modified if not set
+type WireguardConfig struct {
+	PrivateKey *WireguardKey
+	ListenPort int
+	// ReplacePeers removes the peers that are not in the configuration
+	ReplacePeers bool
+	Peers        []WireguardPeer
+}
+
+// CreateWireguard creates a WireGuard interface and sets it up
+func CreateWireguard(name string, mtu int) error {
+	wg := &netlink.GenericLink{
+		LinkAttrs: netlink.LinkAttrs{
+			Name: name,
+			MTU:  mtu,
+		},
+		LinkType: "wireguard",
+	}
+	if err := netlink.LinkAdd(wg); err != nil {
+		return err
+	}
+	return netlink.LinkSetUp(wg)
+}
+
+// ConfigureWireguard configures the keys and peers of a WireGuard interface
+func ConfigureWireguard(name string, cfg WireguardConfig) error {
+	family, err := netlink.GenlFamilyGet(wgGenlName)
+	if err != nil {
+		return err
+	}
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(&nl.Genlmsg{
+		Command: wgCmdSetDevice,
+		Version: uint8(family.Version),
+	})
+	req.AddData(nl.NewRtAttr(wgDeviceAIfname, nl.ZeroTerminated(name)))
+	if cfg.PrivateKey != nil {
+		req.AddData(nl.NewRtAttr(wgDeviceAPrivateKey, cfg.PrivateKey[:]))
+	}
+	if cfg.ListenPort != 0 {
+		req.AddData(nl.NewRtAttr(wgDeviceAListenPort, nl.Uint16Attr(uint16(cfg.ListenPort))))
+	}
+	if cfg.ReplacePeers {
+		req.AddData(nl.NewRtAttr(wgDeviceAFlags, nl.Uint32Attr(wgDeviceFReplacePeers)))
+	}
+
+	peers := nl.NewRtAttr(wgDeviceAPeers|nl.NLA_F_NESTED, nil)
+	for _, p := range cfg.Peers {
+		peer := peers.AddRtAttr(nl.NLA_F_NESTED, nil)
+		peer.AddRtAttr(wgPeerAPublicKey, p.PublicKey[:])
+		peer.AddRtAttr(wgPeerAFlags, nl.Uint32Attr(wgPeerFReplaceAllowedIPs))
+		if p.Endpoint != nil {
+			peer.AddRtAttr(wgPeerAEndpoint, sockaddr(p.Endpoint))
+		}
+		peer.AddRtAttr(wgPeerAPersistentKeepaliveInterval, nl.Uint16Attr(p.PersistentKeepalive))
+		allowedIPs := peer.AddRtAttr(wgPeerAAllowedIPs|nl.NLA_F_NESTED, nil)
+		for _, subnet := range p.AllowedIPs {
+			family, ip := unix.AF_INET, subnet.IP.To4()
+			if ip == nil {
+				family, ip = unix.AF_INET6, subnet.IP.To16()
+			}
+			ones, _ := subnet.Mask.Size()
+			allowedIP := allowedIPs.AddRtAttr(nl.NLA_F_NESTED, nil)
+			allowedIP.AddRtAttr(wgAllowedIPAFamily, nl.Uint16Attr(uint16(family)))
+			allowedIP.AddRtAttr(wgAllowedIPAIPAddr, ip)
+			allowedIP.AddRtAttr(wgAllowedIPACidrMask, nl.Uint8Attr(uint8(ones)))
+		}
+	}
+	req.AddData(peers)
+
+	_, err = req.Execute(unix.NETLINK_GENERIC, 0)
+	return err
+}
+
+// sockaddr returns the struct sockaddr_in or sockaddr_in6 of the address
+func sockaddr(addr *net.UDPAddr) []byte {
+	native := nl.NativeEndian()
+	if ip := addr.IP.To4(); ip != nil {
+		b := make([]byte, unix.SizeofSockaddrInet4)
+		native.PutUint16(b[0:2], unix.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+		copy(b[4:8], ip)
+		return b
+	}
+	b := make([]byte, unix.SizeofSockaddrInet6)
+	native.PutUint16(b[0:2], unix.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[8:24], addr.IP.To16())
+	return b
+}
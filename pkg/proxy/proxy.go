@@ -0,0 +1,140 @@
+// Package proxy implements an HTTP forward proxy, the HTTPS traffic
+// is tunneled with the CONNECT method
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are the hop-by-hop headers removed from the forwarded requests and responses
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Proxy is an http.Handler that forwards the requests to their destinations
+type Proxy struct {
+	// Dial opens the connections to the destinations, net.Dialer if nil
+	Dial func(ctx context.Context, network, address string) (net.Conn, error)
+	// Log is called for each request with the method, the destination and
+	// the error, if any
+	Log func(method, host string, err error)
+
+	once      sync.Once
+	transport *http.Transport
+}
+
+// ServeHTTP forwards the request, or tunnels the connection for CONNECT requests
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.once.Do(func() {
+		if p.Dial == nil {
+			p.Dial = (&net.Dialer{}).DialContext
+		}
+		p.transport = &http.Transport{
+			DialContext:         p.Dial,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		}
+	})
+	var err error
+	if r.Method == http.MethodConnect {
+		err = p.tunnel(w, r)
+	} else {
+		err = p.forward(w, r)
+	}
+	if p.Log != nil {
+		p.Log(r.Method, r.Host, err)
+	}
+}
+
+// tunnel connects the client with the destination of the CONNECT request
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return http.ErrNotSupported
+	}
+	dst, err := p.Dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	src, buf, err := hijacker.Hijack()
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	// the client may have sent data after the request
+	if n := buf.Reader.Buffered(); n > 0 {
+		data, _ := buf.Reader.Peek(n)
+		if _, err := dst.Write(data); err != nil {
+			src.Close()
+			dst.Close()
+			return err
+		}
+	}
+	go pipe(dst, src)
+	go pipe(src, dst)
+	return nil
+}
+
+// pipe copies the data until one of the connections is closed, and closes both
+func pipe(dst, src net.Conn) {
+	defer dst.Close()
+	defer src.Close()
+	io.Copy(dst, src)
+}
+
+// forward sends the request with an absolute URL to the destination
+func (p *Proxy) forward(w http.ResponseWriter, r *http.Request) error {
+	if !r.URL.IsAbs() {
+		http.Error(w, "the request URL must be absolute", http.StatusBadRequest)
+		return nil
+	}
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for k, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// removeHopHeaders removes the hop-by-hop headers, and the
+// headers listed in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, f := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(f))
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
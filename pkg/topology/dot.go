@@ -0,0 +1,73 @@
+package topology
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteDot renders the graph in the Graphviz dot language, the networks
+// are boxes, the routers diamonds, the clusters subgraphs with their nodes
+// and the hosts 3D boxes.
+// The attachments to the networks are labeled with the interface addresses and
+// the links between networks are dashed arrows labeled with the impairments.
+func WriteDot(w io.Writer, g *Graph) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(g.Name))
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=9, dir=none];\n")
+
+	for _, n := range g.Networks {
+		label := append([]string{n.Name}, n.Subnets...)
+		fmt.Fprintf(&b, "  %s [shape=box, style=\"rounded,filled\", fillcolor=\"#dae8fc\", label=%s];\n",
+			dotQuote("network:"+n.Name), dotQuote(strings.Join(label, "\n")))
+	}
+	for _, r := range g.Routers {
+		fmt.Fprintf(&b, "  %s [shape=diamond, style=filled, fillcolor=\"#fff2cc\", label=%s];\n",
+			dotQuote("router:"+r.Name), dotQuote(r.Name))
+		for _, i := range r.Interfaces {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n",
+				dotQuote("router:"+r.Name), dotQuote("network:"+i.Network), dotQuote(strings.Join(interfaceLabel(i), "\n")))
+		}
+	}
+	for _, c := range g.Clusters {
+		fmt.Fprintf(&b, "  subgraph %s {\n", dotQuote("cluster_"+c.Name))
+		fmt.Fprintf(&b, "    label=%s;\n", dotQuote(c.Name))
+		b.WriteString("    style=dashed;\n")
+		for _, n := range c.Nodes {
+			fmt.Fprintf(&b, "    %s [shape=component, label=%s];\n",
+				dotQuote("node:"+n.Name), dotQuote(strings.Join(nodeLabel(n), "\n")))
+		}
+		b.WriteString("  }\n")
+		for _, n := range c.Nodes {
+			for _, i := range n.Interfaces {
+				fmt.Fprintf(&b, "  %s -> %s [label=%s];\n",
+					dotQuote("node:"+n.Name), dotQuote("network:"+i.Network), dotQuote(strings.Join(interfaceLabel(i), "\n")))
+			}
+		}
+	}
+	for _, h := range g.Hosts {
+		fmt.Fprintf(&b, "  %s [shape=box3d, label=%s];\n", dotQuote("host:"+h.Name), dotQuote(h.Name))
+		for _, i := range h.Interfaces {
+			fmt.Fprintf(&b, "  %s -> %s [label=%s];\n",
+				dotQuote("host:"+h.Name), dotQuote("network:"+i.Network), dotQuote(strings.Join(interfaceLabel(i), "\n")))
+		}
+	}
+	for _, l := range g.Links {
+		fmt.Fprintf(&b, "  %s -> %s [dir=forward, style=dashed, color=\"#b85450\", label=%s];\n",
+			dotQuote("network:"+l.From), dotQuote("network:"+l.To), dotQuote(l.Label))
+	}
+	b.WriteString("}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotQuote returns the string as a dot quoted ID
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
@@ -0,0 +1,76 @@
+package topology
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteMermaid renders the graph as a Mermaid flowchart, with the same
+// shapes and edges as WriteDot. The Mermaid IDs are generated because
+// the names of the docker objects may contain invalid characters.
+func WriteMermaid(w io.Writer, g *Graph) error {
+	var b strings.Builder
+	ids := map[string]string{}
+	id := func(key string) string {
+		if _, ok := ids[key]; !ok {
+			ids[key] = fmt.Sprintf("n%d", len(ids))
+		}
+		return ids[key]
+	}
+
+	b.WriteString("flowchart LR\n")
+	for _, n := range g.Networks {
+		label := append([]string{n.Name}, n.Subnets...)
+		fmt.Fprintf(&b, "  %s[(%s)]\n", id("network:"+n.Name), mermaidQuote(label))
+	}
+	for _, r := range g.Routers {
+		fmt.Fprintf(&b, "  %s{%s}\n", id("router:"+r.Name), mermaidQuote([]string{r.Name}))
+	}
+	for _, c := range g.Clusters {
+		fmt.Fprintf(&b, "  subgraph %s[%s]\n", id("cluster:"+c.Name), mermaidQuote([]string{c.Name}))
+		for _, n := range c.Nodes {
+			fmt.Fprintf(&b, "    %s[%s]\n", id("node:"+n.Name), mermaidQuote(nodeLabel(n)))
+		}
+		b.WriteString("  end\n")
+	}
+	for _, h := range g.Hosts {
+		fmt.Fprintf(&b, "  %s[/%s/]\n", id("host:"+h.Name), mermaidQuote([]string{h.Name}))
+	}
+	for _, r := range g.Routers {
+		for _, i := range r.Interfaces {
+			fmt.Fprintf(&b, "  %s ---|%s| %s\n",
+				id("router:"+r.Name), mermaidQuote(interfaceLabel(i)), id("network:"+i.Network))
+		}
+	}
+	for _, c := range g.Clusters {
+		for _, n := range c.Nodes {
+			for _, i := range n.Interfaces {
+				fmt.Fprintf(&b, "  %s ---|%s| %s\n",
+					id("node:"+n.Name), mermaidQuote(interfaceLabel(i)), id("network:"+i.Network))
+			}
+		}
+	}
+	for _, h := range g.Hosts {
+		for _, i := range h.Interfaces {
+			fmt.Fprintf(&b, "  %s ---|%s| %s\n",
+				id("host:"+h.Name), mermaidQuote(interfaceLabel(i)), id("network:"+i.Network))
+		}
+	}
+	for _, l := range g.Links {
+		fmt.Fprintf(&b, "  %s -.->|%s| %s\n",
+			id("network:"+l.From), mermaidQuote([]string{l.Label}), id("network:"+l.To))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidQuote returns the lines as a Mermaid quoted label
+func mermaidQuote(lines []string) string {
+	escaped := []string{}
+	for _, l := range lines {
+		escaped = append(escaped, strings.ReplaceAll(l, `"`, "#quot;"))
+	}
+	return `"` + strings.Join(escaped, "<br/>") + `"`
+}
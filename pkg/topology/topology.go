@@ -0,0 +1,164 @@
+// Package topology describes the networks, routers and clusters created by
+// the plugins, so they can be rendered as diagrams
+package topology
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/aojea/kind-networking-plugins/pkg/docker"
+
+	"sigs.k8s.io/kind/pkg/cluster/nodes"
+)
+
+// Graph is the topology of a deployment
+type Graph struct {
+	Name     string
+	Networks []Network
+	Routers  []Router
+	Clusters []Cluster
+	Hosts    []Host
+	// Links are the impairments of the traffic between networks
+	Links []Link
+}
+
+// Network is a docker network
+type Network struct {
+	Name    string
+	Subnets []string
+}
+
+// Interface is the attachment of a container to a network
+type Interface struct {
+	Network   string
+	Name      string
+	Addresses []string
+	// Impairments are applied to all the traffic sent through the interface
+	Impairments []string
+}
+
+// Router is a container that forwards traffic between networks
+type Router struct {
+	Name       string
+	Interfaces []Interface
+}
+
+// Cluster is a KIND cluster
+type Cluster struct {
+	Name  string
+	Nodes []Node
+}
+
+// Node is a node of a KIND cluster
+type Node struct {
+	Name       string
+	Role       string
+	Zone       string
+	Interfaces []Interface
+}
+
+// Host is a standalone container attached to the networks
+type Host struct {
+	Name       string
+	Interfaces []Interface
+}
+
+// Link is the impairment of the traffic from a network to another
+type Link struct {
+	From  string
+	To    string
+	Label string
+}
+
+// Write renders the graph in the format passed, dot or mermaid
+func Write(w io.Writer, g *Graph, format string) error {
+	switch format {
+	case "dot":
+		return WriteDot(w, g)
+	case "mermaid":
+		return WriteMermaid(w, g)
+	default:
+		return fmt.Errorf("unsupported diagram format %q", format)
+	}
+}
+
+// IsFormat returns true if the output format is a diagram format
+func IsFormat(format string) bool {
+	return format == "dot" || format == "mermaid"
+}
+
+// interfaceLabel returns the name and the addresses of the interface
+func interfaceLabel(i Interface) []string {
+	label := []string{}
+	if i.Name != "" {
+		label = append(label, i.Name)
+	}
+	label = append(label, i.Addresses...)
+	return append(label, i.Impairments...)
+}
+
+// nodeLabel returns the name, role, zone and addresses of the node
+func nodeLabel(n Node) []string {
+	label := []string{n.Name}
+	if n.Role != "" {
+		label = append(label, n.Role)
+	}
+	if n.Zone != "" {
+		label = append(label, "zone: "+n.Zone)
+	}
+	return label
+}
+
+// NewNetworks returns the docker networks with their subnets
+func NewNetworks(names []string) ([]Network, error) {
+	networks := []Network{}
+	for _, name := range names {
+		subnets, err := docker.GetNetworkSubnets(name)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, Network{Name: name, Subnets: subnets})
+	}
+	return networks, nil
+}
+
+// ContainerInterfaces returns the attachments of the container to the networks,
+// the networks the container is not connected to are omitted
+func ContainerInterfaces(name string, networks []string) ([]Interface, error) {
+	interfaces := []Interface{}
+	for _, network := range networks {
+		ips, err := docker.GetContainerIPs(name, network)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		interfaces = append(interfaces, Interface{Network: network, Addresses: ips})
+	}
+	return interfaces, nil
+}
+
+// NewCluster returns the cluster with its nodes sorted by name and
+// the attachments of the nodes to the networks
+func NewCluster(name string, clusterNodes []nodes.Node, networks []string) (Cluster, error) {
+	c := Cluster{Name: name}
+	for _, n := range clusterNodes {
+		role, err := n.Role()
+		if err != nil {
+			return c, err
+		}
+		interfaces, err := ContainerInterfaces(n.String(), networks)
+		if err != nil {
+			return c, err
+		}
+		c.Nodes = append(c.Nodes, Node{
+			Name:       n.String(),
+			Role:       role,
+			Interfaces: interfaces,
+		})
+	}
+	sort.Slice(c.Nodes, func(i, j int) bool { return c.Nodes[i].Name < c.Nodes[j].Name })
+	return c, nil
+}